@@ -1,12 +1,205 @@
 package compiler
 
-import "github.com/iafisher/torino/data"
+import (
+	"github.com/iafisher/torino/data"
+	"github.com/iafisher/torino/lexer"
+)
 
+// An operation of the virtual machine. In encoded bytecode, each opcode is followed
+// by a fixed number of operands, one word each.
+type Opcode uint32
+
+const (
+	PUSH_CONST Opcode = iota
+	LOAD_LOCAL
+	STORE_LOCAL
+	LOAD_CELL
+	STORE_CELL
+	DEFINE_CELL
+	LOAD_UPVALUE
+	STORE_UPVALUE
+	LOAD_GLOBAL
+	DEFINE_GLOBAL
+	STORE_GLOBAL
+	POP_STACK
+	DUP_TOP_TWO
+	ROT_TWO
+
+	BINARY_ADD
+	BINARY_SUB
+	BINARY_MUL
+	BINARY_DIV
+	BINARY_FLOOR_DIV
+	BINARY_MOD
+	BINARY_EQ
+	BINARY_NE
+	BINARY_GT
+	BINARY_LT
+	BINARY_GE
+	BINARY_LE
+	BINARY_IN
+	BINARY_INDEX
+	STORE_INDEX
+	UNARY_MINUS
+	UNARY_NOT
+
+	MAKE_CLOSURE
+	CALL_FUNCTION
+	CALL_METHOD
+	LOAD_ATTR
+	RETURN_VALUE
+	MAKE_LIST
+	MAKE_MAP
+
+	GET_ITER
+	FOR_ITER
+	UNPACK_SEQUENCE
+
+	REL_JUMP
+	REL_JUMP_IF_FALSE
+	REL_JUMP_IF_FALSE_OR_POP
+	REL_JUMP_IF_TRUE_OR_POP
+)
+
+// The kinds of operands that an instruction can take.
+type OperandKind int
+
+const (
+	// An index into the constant pool of the code object.
+	OPERAND_CONST OperandKind = iota
+	// An index into the name table of the code object.
+	OPERAND_NAME
+	// A slot in the local variables of the current call frame.
+	OPERAND_LOCAL
+	// An index into the upvalues of the current closure.
+	OPERAND_UPVALUE
+	// A count, e.g. the number of arguments to a function.
+	OPERAND_COUNT
+	// A jump offset, relative to the start of the instruction.
+	OPERAND_JUMP
+)
+
+type opcodeInfo struct {
+	name     string
+	operands []OperandKind
+}
+
+var opcodeTable = [...]opcodeInfo{
+	PUSH_CONST:    {"PUSH_CONST", []OperandKind{OPERAND_CONST}},
+	LOAD_LOCAL:    {"LOAD_LOCAL", []OperandKind{OPERAND_LOCAL}},
+	STORE_LOCAL:   {"STORE_LOCAL", []OperandKind{OPERAND_LOCAL}},
+	LOAD_CELL:     {"LOAD_CELL", []OperandKind{OPERAND_LOCAL}},
+	STORE_CELL:    {"STORE_CELL", []OperandKind{OPERAND_LOCAL}},
+	DEFINE_CELL:   {"DEFINE_CELL", []OperandKind{OPERAND_LOCAL}},
+	LOAD_UPVALUE:  {"LOAD_UPVALUE", []OperandKind{OPERAND_UPVALUE}},
+	STORE_UPVALUE: {"STORE_UPVALUE", []OperandKind{OPERAND_UPVALUE}},
+	LOAD_GLOBAL:   {"LOAD_GLOBAL", []OperandKind{OPERAND_NAME}},
+	DEFINE_GLOBAL: {"DEFINE_GLOBAL", []OperandKind{OPERAND_NAME}},
+	STORE_GLOBAL:  {"STORE_GLOBAL", []OperandKind{OPERAND_NAME}},
+	POP_STACK:     {"POP_STACK", nil},
+	DUP_TOP_TWO:   {"DUP_TOP_TWO", nil},
+	ROT_TWO:       {"ROT_TWO", nil},
+
+	BINARY_ADD:       {"BINARY_ADD", nil},
+	BINARY_SUB:       {"BINARY_SUB", nil},
+	BINARY_MUL:       {"BINARY_MUL", nil},
+	BINARY_DIV:       {"BINARY_DIV", nil},
+	BINARY_FLOOR_DIV: {"BINARY_FLOOR_DIV", nil},
+	BINARY_MOD:       {"BINARY_MOD", nil},
+	BINARY_EQ:        {"BINARY_EQ", nil},
+	BINARY_NE:        {"BINARY_NE", nil},
+	BINARY_GT:        {"BINARY_GT", nil},
+	BINARY_LT:        {"BINARY_LT", nil},
+	BINARY_GE:        {"BINARY_GE", nil},
+	BINARY_LE:        {"BINARY_LE", nil},
+	BINARY_IN:        {"BINARY_IN", nil},
+	BINARY_INDEX:     {"BINARY_INDEX", nil},
+	STORE_INDEX:      {"STORE_INDEX", nil},
+	UNARY_MINUS:      {"UNARY_MINUS", nil},
+	UNARY_NOT:        {"UNARY_NOT", nil},
+
+	MAKE_CLOSURE:  {"MAKE_CLOSURE", []OperandKind{OPERAND_CONST}},
+	CALL_FUNCTION: {"CALL_FUNCTION", []OperandKind{OPERAND_COUNT}},
+	CALL_METHOD:   {"CALL_METHOD", []OperandKind{OPERAND_NAME, OPERAND_COUNT}},
+	LOAD_ATTR:     {"LOAD_ATTR", []OperandKind{OPERAND_NAME}},
+	RETURN_VALUE:  {"RETURN_VALUE", nil},
+	MAKE_LIST:     {"MAKE_LIST", []OperandKind{OPERAND_COUNT}},
+	MAKE_MAP:      {"MAKE_MAP", []OperandKind{OPERAND_COUNT}},
+
+	GET_ITER:        {"GET_ITER", []OperandKind{OPERAND_COUNT}},
+	FOR_ITER:        {"FOR_ITER", []OperandKind{OPERAND_JUMP}},
+	UNPACK_SEQUENCE: {"UNPACK_SEQUENCE", []OperandKind{OPERAND_COUNT}},
+
+	REL_JUMP:                 {"REL_JUMP", []OperandKind{OPERAND_JUMP}},
+	REL_JUMP_IF_FALSE:        {"REL_JUMP_IF_FALSE", []OperandKind{OPERAND_JUMP}},
+	REL_JUMP_IF_FALSE_OR_POP: {"REL_JUMP_IF_FALSE_OR_POP", []OperandKind{OPERAND_JUMP}},
+	REL_JUMP_IF_TRUE_OR_POP:  {"REL_JUMP_IF_TRUE_OR_POP", []OperandKind{OPERAND_JUMP}},
+}
+
+func (op Opcode) String() string {
+	if int(op) < len(opcodeTable) {
+		return opcodeTable[op].name
+	} else {
+		return "UNKNOWN"
+	}
+}
+
+// Return the kinds of the operands that follow the opcode in encoded bytecode.
+func (op Opcode) Operands() []OperandKind {
+	return opcodeTable[op].operands
+}
+
+// Return the number of words that an instruction with the opcode occupies in
+// encoded bytecode.
+func (op Opcode) Width() int {
+	return 1 + len(opcodeTable[op].operands)
+}
+
+// An instruction as emitted by the compiler, before it is encoded. Jump offsets
+// are counted in instructions rather than words.
 type Instruction struct {
-	Name string
-	Args []data.TorinoValue
+	Op   Opcode
+	Args []int
+	// The location in the source code of the node the instruction was compiled
+	// from, for error messages.
+	Loc *lexer.Location
 }
 
-func NewInst(name string, args ...data.TorinoValue) *Instruction {
-	return &Instruction{name, args}
+func NewInst(op Opcode, args ...int) *Instruction {
+	return &Instruction{op, args, nil}
+}
+
+// Encode a sequence of instructions as a code object with the given constant pool,
+// name table and local variables. Jump offsets are converted from instructions to
+// words.
+func Assemble(insts []*Instruction, constants []data.TorinoValue, names []string,
+	locals []string) *TorinoCode {
+	// The offset in words of each instruction, plus the offset of the end of the
+	// code so that jumps past the last instruction can be resolved.
+	offsets := make([]int, len(insts)+1)
+	for i, inst := range insts {
+		offsets[i+1] = offsets[i] + inst.Op.Width()
+	}
+
+	code := &TorinoCode{
+		make([]uint32, 0, offsets[len(insts)]),
+		constants,
+		names,
+		locals,
+		nil,
+		make([]*lexer.Location, offsets[len(insts)]),
+	}
+	for i, inst := range insts {
+		code.Locs[offsets[i]] = inst.Loc
+		code.Code = append(code.Code, uint32(inst.Op))
+		for j, kind := range inst.Op.Operands() {
+			operand := inst.Args[j]
+			if kind == OPERAND_JUMP {
+				operand = offsets[i+operand] - offsets[i]
+			}
+			// Negative jump offsets are stored in two's complement.
+			code.Code = append(code.Code, uint32(int32(operand)))
+		}
+	}
+	return code
 }
@@ -6,40 +6,121 @@ Version: February 2019
 package compiler
 
 import (
-	"errors"
 	"fmt"
 	"github.com/iafisher/torino/data"
+	"github.com/iafisher/torino/errs"
+	"github.com/iafisher/torino/lexer"
 	"github.com/iafisher/torino/parser"
 )
 
-// TODO: I might not even need this struct.
 type Compiler struct {
+	// The loops enclosing the statement currently being compiled, innermost last.
+	loops []*loopInfo
+	// The tables of the code object currently being compiled.
+	tables *codeTables
+	// The names of the variables already defined in the environment.
+	globals []string
+	// Where each variable of the program being compiled is stored.
+	resolved *resolution
+	// The scopes of the function currently being compiled, or of the program.
+	scope *funcScope
+}
+
+// The constant pool and name table of a code object that is being compiled.
+// Constants and names are deduplicated, so that each is stored only once.
+type codeTables struct {
+	constants  []data.TorinoValue
+	constIndex map[string]int
+	names      []string
+	nameIndex  map[string]int
+}
+
+func newCodeTables() *codeTables {
+	return &codeTables{[]data.TorinoValue{}, map[string]int{}, []string{}, map[string]int{}}
+}
+
+// Book-keeping for a loop whose body is being compiled, so that break and continue
+// statements can be patched with the correct jump offsets once the loop's full code
+// is known.
+type loopInfo struct {
+	breaks    []*Instruction
+	continues []*Instruction
 }
 
 func New() *Compiler {
-	return &Compiler{}
+	return &Compiler{nil, newCodeTables(), nil, nil, nil}
 }
 
-func (cmp *Compiler) Compile(ast *parser.BlockNode) ([]*Instruction, error) {
-	program := []*Instruction{}
-	for _, stmt := range ast.Statements {
+// Declare names that are defined in the environment that compiled programs will run
+// in, e.g. builtins, so that programs may refer to them.
+func (cmp *Compiler) DeclareGlobals(names []string) {
+	cmp.globals = append(cmp.globals, names...)
+}
+
+// Compile a top-level program. All statements leave the stack as they found it,
+// except that if the last statement is an expression its value is left on the stack
+// as the result of the program.
+func (cmp *Compiler) Compile(ast *parser.BlockNode) (*TorinoCode, error) {
+	resolved, err := resolve(ast, cmp.globals)
+	if err != nil {
+		return nil, err
+	}
+
+	cmp.resolved = resolved
+	cmp.scope = resolved.scopes[ast]
+	cmp.tables = newCodeTables()
+	program, err := cmp.compileBlock(ast)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(ast.Statements)
+	if n > 0 {
+		if _, ok := ast.Statements[n-1].(*parser.ExpressionStatement); ok {
+			// Drop the final POP_STACK.
+			program = program[:len(program)-1]
+		}
+	}
+	return Assemble(program, cmp.tables.constants, cmp.tables.names, cmp.scope.locals), nil
+}
+
+func (cmp *Compiler) compileBlock(block *parser.BlockNode) ([]*Instruction, error) {
+	insts := []*Instruction{}
+	for _, stmt := range block.Statements {
 		stmtCode, err := cmp.compileStatement(stmt)
 		if err != nil {
 			return nil, err
 		}
-		program = append(program, stmtCode...)
+		insts = append(insts, stmtCode...)
 	}
-	return program, nil
+	return insts, nil
 }
 
 func (cmp *Compiler) compileStatement(stmt parser.Statement) ([]*Instruction, error) {
+	insts, err := cmp.compileStatementNode(stmt)
+	if err != nil {
+		return nil, err
+	}
+	setLocation(insts, stmt.Location())
+	return insts, nil
+}
+
+func (cmp *Compiler) compileStatementNode(stmt parser.Statement) ([]*Instruction, error) {
 	switch v := stmt.(type) {
 	case *parser.ExpressionStatement:
-		return cmp.compileExpression(v.Expr)
+		insts, err := cmp.compileExpression(v.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return append(insts, NewInst(POP_STACK)), nil
 	case *parser.LetNode:
 		return cmp.compileLet(v)
 	case *parser.AssignNode:
 		return cmp.compileAssign(v)
+	case *parser.IndexAssignNode:
+		return cmp.compileIndexAssign(v)
+	case *parser.CompoundAssignNode:
+		return cmp.compileCompoundAssign(v)
 	case *parser.IfNode:
 		return cmp.compileIf(v)
 	case *parser.FnNode:
@@ -50,22 +131,38 @@ func (cmp *Compiler) compileStatement(stmt parser.Statement) ([]*Instruction, er
 		return cmp.compileWhile(v)
 	case *parser.ForNode:
 		return cmp.compileFor(v)
+	case *parser.BreakNode:
+		return cmp.compileBreak(v)
+	case *parser.ContinueNode:
+		return cmp.compileContinue(v)
 	default:
-		return nil, errors.New(fmt.Sprintf("unknown statement type %T", stmt))
+		return nil, errs.NewCompileError(
+			stmt.Location(), errs.CODE_INTERNAL, fmt.Sprintf("unknown statement type %T", stmt))
 	}
 }
 
 func (cmp *Compiler) compileExpression(expr parser.Expression) ([]*Instruction, error) {
+	insts, err := cmp.compileExpressionNode(expr)
+	if err != nil {
+		return nil, err
+	}
+	setLocation(insts, expr.Location())
+	return insts, nil
+}
+
+func (cmp *Compiler) compileExpressionNode(expr parser.Expression) ([]*Instruction, error) {
 	insts := []*Instruction{}
 	switch v := expr.(type) {
 	case *parser.IntegerNode:
-		return append(insts, NewInst("PUSH_CONST", &data.TorinoInt{v.Value})), nil
+		return append(insts, NewInst(PUSH_CONST, cmp.addConst(&data.TorinoInt{v.Value}))), nil
 	case *parser.SymbolNode:
-		return append(insts, NewInst("PUSH_NAME", &data.TorinoString{v.Value})), nil
+		return append(insts, cmp.load(v)), nil
 	case *parser.BoolNode:
-		return append(insts, NewInst("PUSH_CONST", &data.TorinoBool{v.Value})), nil
+		return append(insts, NewInst(PUSH_CONST, cmp.addConst(&data.TorinoBool{v.Value}))), nil
 	case *parser.StringNode:
-		return append(insts, NewInst("PUSH_CONST", &data.TorinoString{v.Value})), nil
+		return append(insts, NewInst(PUSH_CONST, cmp.addConst(&data.TorinoString{v.Value}))), nil
+	case *parser.NoneNode:
+		return append(insts, NewInst(PUSH_CONST, cmp.addConst(&data.TorinoNone{}))), nil
 	case *parser.ListNode:
 		return cmp.compileList(v)
 	case *parser.MapNode:
@@ -78,8 +175,24 @@ func (cmp *Compiler) compileExpression(expr parser.Expression) ([]*Instruction,
 		return cmp.compileCall(v)
 	case *parser.IndexNode:
 		return cmp.compileIndex(v)
+	case *parser.AttrNode:
+		return cmp.compileAttr(v)
+	case *parser.FnExpressionNode:
+		return cmp.compileFunction("<anonymous>", v.Params, v.Body)
 	default:
-		return nil, errors.New(fmt.Sprintf("unknown expression type %+v (%T)", expr, expr))
+		return nil, errs.NewCompileError(expr.Location(), errs.CODE_INTERNAL,
+			fmt.Sprintf("unknown expression type %+v (%T)", expr, expr))
+	}
+}
+
+// Attach a source location to the instructions that do not already have one. Since
+// nodes are compiled inside-out, each instruction ends up with the location of the
+// innermost node that produced it.
+func setLocation(insts []*Instruction, loc *lexer.Location) {
+	for _, inst := range insts {
+		if inst.Loc == nil {
+			inst.Loc = loc
+		}
 	}
 }
 
@@ -88,7 +201,7 @@ func (cmp *Compiler) compileLet(node *parser.LetNode) ([]*Instruction, error) {
 	if err != nil {
 		return nil, err
 	}
-	return append(insts, NewInst("STORE_NAME", &data.TorinoString{node.Destination.Value})), nil
+	return append(insts, cmp.define(node.Destination)), nil
 }
 
 func (cmp *Compiler) compileAssign(node *parser.AssignNode) ([]*Instruction, error) {
@@ -97,8 +210,69 @@ func (cmp *Compiler) compileAssign(node *parser.AssignNode) ([]*Instruction, err
 		return nil, err
 	}
 
-	insts = append(insts, NewInst("ASSIGN_NAME", &data.TorinoString{node.Destination.Value}))
-	return insts, nil
+	return append(insts, cmp.store(node.Destination)), nil
+}
+
+func (cmp *Compiler) compileIndexAssign(node *parser.IndexAssignNode) ([]*Instruction, error) {
+	insts, err := cmp.compileExpression(node.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	indexedCode, err := cmp.compileExpression(node.Indexed)
+	if err != nil {
+		return nil, err
+	}
+
+	valueCode, err := cmp.compileExpression(node.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	insts = append(insts, indexedCode...)
+	insts = append(insts, valueCode...)
+	return append(insts, NewInst(STORE_INDEX)), nil
+}
+
+func (cmp *Compiler) compileCompoundAssign(node *parser.CompoundAssignNode) ([]*Instruction, error) {
+	opInst, err := binaryInstruction(node.Op, node.Loc)
+	if err != nil {
+		return nil, err
+	}
+
+	valueCode, err := cmp.compileExpression(node.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch dest := node.Destination.(type) {
+	case *parser.SymbolNode:
+		insts := valueCode
+		insts = append(insts, cmp.load(dest), opInst)
+		return append(insts, cmp.store(dest)), nil
+	case *parser.IndexNode:
+		insts, err := cmp.compileExpression(dest.Index)
+		if err != nil {
+			return nil, err
+		}
+
+		indexedCode, err := cmp.compileExpression(dest.Indexed)
+		if err != nil {
+			return nil, err
+		}
+		insts = append(insts, indexedCode...)
+
+		// The index and the indexed value are each evaluated only once, and are
+		// duplicated so that they are still on the stack for STORE_INDEX after the
+		// old value has been looked up.
+		insts = append(insts, NewInst(DUP_TOP_TWO), NewInst(BINARY_INDEX))
+		insts = append(insts, valueCode...)
+		insts = append(insts, NewInst(ROT_TWO), opInst, NewInst(STORE_INDEX))
+		return insts, nil
+	default:
+		return nil, errs.NewCompileError(node.Loc, errs.CODE_INVALID_TARGET,
+			fmt.Sprintf("invalid target for %s=", node.Op))
+	}
 }
 
 func (cmp *Compiler) compileIf(ifNode *parser.IfNode) ([]*Instruction, error) {
@@ -111,7 +285,7 @@ func (cmp *Compiler) compileIf(ifNode *parser.IfNode) ([]*Instruction, error) {
 			return nil, err
 		}
 
-		body, err := cmp.Compile(clause.Body)
+		body, err := cmp.compileBlock(clause.Body)
 		if err != nil {
 			return nil, err
 		}
@@ -119,13 +293,15 @@ func (cmp *Compiler) compileIf(ifNode *parser.IfNode) ([]*Instruction, error) {
 		compiledConds = append(compiledConds, cond)
 		compiledBodies = append(compiledBodies, body)
 
-		endJump += len(cond) + len(body) + 1
+		// The condition and the body, plus the conditional jump over the body and the
+		// jump to the end of the statement.
+		endJump += len(cond) + len(body) + 2
 	}
 
 	var elseCode []*Instruction
 	var err error
 	if ifNode.Else != nil {
-		elseCode, err = cmp.Compile(ifNode.Else)
+		elseCode, err = cmp.compileBlock(ifNode.Else)
 		if err != nil {
 			return nil, err
 		}
@@ -135,15 +311,15 @@ func (cmp *Compiler) compileIf(ifNode *parser.IfNode) ([]*Instruction, error) {
 
 	insts := []*Instruction{}
 	for i, code := range compiledBodies {
-		endJump -= (len(code) + len(compiledConds[i]) + 1)
+		endJump -= (len(code) + len(compiledConds[i]) + 2)
 
 		insts = append(insts, compiledConds[i]...)
-		jump := &data.TorinoInt{len(code) + 2}
+		jump := len(code) + 2
 
-		insts = append(insts, NewInst("REL_JUMP_IF_FALSE", jump))
+		insts = append(insts, NewInst(REL_JUMP_IF_FALSE, jump))
 
 		insts = append(insts, code...)
-		insts = append(insts, NewInst("REL_JUMP", &data.TorinoInt{endJump + 1}))
+		insts = append(insts, NewInst(REL_JUMP, endJump+1))
 	}
 
 	if elseCode != nil {
@@ -154,23 +330,163 @@ func (cmp *Compiler) compileIf(ifNode *parser.IfNode) ([]*Instruction, error) {
 }
 
 func (cmp *Compiler) compileFn(fnNode *parser.FnNode) ([]*Instruction, error) {
-	insts := []*Instruction{}
+	closureCode, err := cmp.compileFunction(fnNode.Symbol.Value, fnNode.Params, fnNode.Body)
+	if err != nil {
+		return nil, err
+	}
 
-	body, err := cmp.Compile(fnNode.Body)
+	b := cmp.resolved.bindings[fnNode.Symbol]
+	if b.kind == BINDING_LOCAL && cmp.scope.captured[b.slot] {
+		// The function may capture itself, so its cell must exist before the closure
+		// is created.
+		insts := []*Instruction{
+			NewInst(PUSH_CONST, cmp.addConst(&data.TorinoNone{})), NewInst(DEFINE_CELL, b.slot),
+		}
+		insts = append(insts, closureCode...)
+		return append(insts, cmp.store(fnNode.Symbol)), nil
+	}
+	return append(closureCode, cmp.define(fnNode.Symbol)), nil
+}
+
+// Compile a function into its own code object, and return the instructions that
+// create a closure of it.
+func (cmp *Compiler) compileFunction(
+	name string, paramNodes []*parser.SymbolNode, block *parser.BlockNode) ([]*Instruction, error) {
+	// Loops outside the function do not enclose its body, and the body is compiled
+	// into its own code object.
+	enclosingLoops := cmp.loops
+	enclosingTables := cmp.tables
+	enclosingScope := cmp.scope
+	cmp.loops = nil
+	cmp.tables = newCodeTables()
+	cmp.scope = cmp.resolved.scopes[block]
+
+	// Captured parameters are moved into cells before the body runs.
+	body := []*Instruction{}
+	for i := range paramNodes {
+		if cmp.scope.captured[i] {
+			body = append(body, NewInst(LOAD_LOCAL, i), NewInst(DEFINE_CELL, i))
+		}
+	}
+
+	blockCode, err := cmp.compileBlock(block)
 	if err != nil {
 		return nil, err
 	}
+	body = append(body, blockCode...)
+
+	// Functions without an explicit return statement return none.
+	none := cmp.addConst(&data.TorinoNone{})
+	body = append(body, NewInst(PUSH_CONST, none), NewInst(RETURN_VALUE))
+	bodyCode := Assemble(body, cmp.tables.constants, cmp.tables.names, cmp.scope.locals)
+	bodyCode.Upvalues = cmp.scope.upvalues
+	cmp.loops = enclosingLoops
+	cmp.tables = enclosingTables
+	cmp.scope = enclosingScope
+
+	params := []string{}
+	for _, param := range paramNodes {
+		params = append(params, param.Value)
+	}
+
+	f := &TorinoFunction{name, params, bodyCode}
+	return []*Instruction{NewInst(MAKE_CLOSURE, cmp.addConst(f))}, nil
+}
+
+// Return the instruction that pushes the value of a variable.
+func (cmp *Compiler) load(sym *parser.SymbolNode) *Instruction {
+	b := cmp.resolved.bindings[sym]
+	if b.kind == BINDING_LOCAL && cmp.scope.captured[b.slot] {
+		return NewInst(LOAD_CELL, b.slot)
+	} else if b.kind == BINDING_LOCAL {
+		return NewInst(LOAD_LOCAL, b.slot)
+	} else if b.kind == BINDING_UPVALUE {
+		return NewInst(LOAD_UPVALUE, b.slot)
+	} else {
+		return NewInst(LOAD_GLOBAL, cmp.addName(sym.Value))
+	}
+}
+
+// Return the instruction that pops a value into a newly declared variable. A new
+// cell is created for a captured variable each time its declaration is executed, so
+// that, e.g., closures created in different iterations of a loop do not share it.
+func (cmp *Compiler) define(sym *parser.SymbolNode) *Instruction {
+	b := cmp.resolved.bindings[sym]
+	if b.kind == BINDING_LOCAL && cmp.scope.captured[b.slot] {
+		return NewInst(DEFINE_CELL, b.slot)
+	} else if b.kind == BINDING_LOCAL {
+		return NewInst(STORE_LOCAL, b.slot)
+	} else {
+		return NewInst(DEFINE_GLOBAL, cmp.addName(sym.Value))
+	}
+}
+
+// Return the instruction that pops a value into an existing variable.
+func (cmp *Compiler) store(sym *parser.SymbolNode) *Instruction {
+	b := cmp.resolved.bindings[sym]
+	if b.kind == BINDING_LOCAL && cmp.scope.captured[b.slot] {
+		return NewInst(STORE_CELL, b.slot)
+	} else if b.kind == BINDING_LOCAL {
+		return NewInst(STORE_LOCAL, b.slot)
+	} else if b.kind == BINDING_UPVALUE {
+		return NewInst(STORE_UPVALUE, b.slot)
+	} else {
+		return NewInst(STORE_GLOBAL, cmp.addName(sym.Value))
+	}
+}
+
+// Return the index of a value in the current constant pool, adding it if needed.
+func (cmp *Compiler) addConst(val data.TorinoValue) int {
+	key, ok := constantKey(val)
+	if ok {
+		if i, ok := cmp.tables.constIndex[key]; ok {
+			return i
+		}
+	}
 
-	insts = append(insts, NewInst("PUSH_CONST", &TorinoFunction{fnNode.Params, body}))
-	return append(insts, NewInst("STORE_NAME", &data.TorinoString{fnNode.Symbol.Value})), nil
+	cmp.tables.constants = append(cmp.tables.constants, val)
+	i := len(cmp.tables.constants) - 1
+	if ok {
+		cmp.tables.constIndex[key] = i
+	}
+	return i
+}
+
+// Return the key under which a constant is deduplicated, or false if it should not
+// be deduplicated. Only immutable values with structural equality are shared.
+func constantKey(val data.TorinoValue) (string, bool) {
+	switch val.(type) {
+	case *data.TorinoInt, *data.TorinoString, *data.TorinoBool, *data.TorinoNone:
+		return val.TypeName() + ":" + val.Repr(), true
+	default:
+		return "", false
+	}
+}
+
+// Return the index of a name in the current name table, adding it if needed.
+func (cmp *Compiler) addName(name string) int {
+	if i, ok := cmp.tables.nameIndex[name]; ok {
+		return i
+	}
+
+	cmp.tables.names = append(cmp.tables.names, name)
+	i := len(cmp.tables.names) - 1
+	cmp.tables.nameIndex[name] = i
+	return i
 }
 
 func (cmp *Compiler) compileReturn(returnNode *parser.ReturnNode) ([]*Instruction, error) {
+	if returnNode.Value == nil {
+		return []*Instruction{
+			NewInst(PUSH_CONST, cmp.addConst(&data.TorinoNone{})), NewInst(RETURN_VALUE),
+		}, nil
+	}
+
 	insts, err := cmp.compileExpression(returnNode.Value)
 	if err != nil {
 		return nil, err
 	}
-	return append(insts, NewInst("RETURN_VALUE")), nil
+	return append(insts, NewInst(RETURN_VALUE)), nil
 }
 
 func (cmp *Compiler) compileWhile(whileNode *parser.WhileNode) ([]*Instruction, error) {
@@ -179,19 +495,26 @@ func (cmp *Compiler) compileWhile(whileNode *parser.WhileNode) ([]*Instruction,
 		return nil, err
 	}
 
-	body, err := cmp.Compile(whileNode.Block)
+	loop := cmp.pushLoop()
+	body, err := cmp.compileBlock(whileNode.Block)
+	cmp.popLoop()
 	if err != nil {
 		return nil, err
 	}
 
 	insts := cond
 
-	endJump := &data.TorinoInt{len(body) + 2}
-	insts = append(insts, NewInst("REL_JUMP_IF_FALSE", endJump))
+	endJump := len(body) + 2
+	insts = append(insts, NewInst(REL_JUMP_IF_FALSE, endJump))
 
 	insts = append(insts, body...)
-	startJump := &data.TorinoInt{-(len(cond) + len(body) + 1)}
-	return append(insts, NewInst("REL_JUMP", startJump)), nil
+	startJump := -(len(cond) + len(body) + 1)
+	insts = append(insts, NewInst(REL_JUMP, startJump))
+
+	// break jumps to just past the loop, continue jumps back to the condition.
+	patchLoopJumps(insts, loop.breaks, len(insts))
+	patchLoopJumps(insts, loop.continues, 0)
+	return insts, nil
 }
 
 func (cmp *Compiler) compileFor(forNode *parser.ForNode) ([]*Instruction, error) {
@@ -201,30 +524,91 @@ func (cmp *Compiler) compileFor(forNode *parser.ForNode) ([]*Instruction, error)
 		return nil, err
 	}
 
-	bodyCode, err := cmp.Compile(forNode.Block)
+	loop := cmp.pushLoop()
+	bodyCode, err := cmp.compileBlock(forNode.Block)
+	cmp.popLoop()
 	if err != nil {
 		return nil, err
 	}
 
-	insts := []*Instruction{
-		// Just need to initialize the loop variable with some throwaway value,
-		// so we can subsequently use ASSIGN_NAME without worrying about an
-		// undefined symbol error. Hacky but it works.
-		NewInst("PUSH_CONST", &data.TorinoInt{0}),
-		NewInst("STORE_NAME", &data.TorinoString{forNode.Symbol.Value}),
+	insts := iterCode
+	nsyms := len(forNode.Symbols)
+	insts = append(insts, NewInst(GET_ITER, nsyms))
+
+	nextPos := len(insts)
+	// The jump offset is filled in below, once the end of the loop is known.
+	nextInst := NewInst(FOR_ITER, 0)
+	insts = append(insts, nextInst)
+	if len(forNode.Symbols) > 1 {
+		insts = append(insts, NewInst(UNPACK_SEQUENCE, nsyms))
+	}
+	for _, sym := range forNode.Symbols {
+		insts = append(insts, cmp.define(sym))
 	}
+	insts = append(insts, bodyCode...)
+	startJump := nextPos - len(insts)
+	insts = append(insts, NewInst(REL_JUMP, startJump))
 
-	insts = append(insts, iterCode...)
+	// Once the loop is finished, the iterator is left on the stack and must be
+	// popped. break jumps here too, and continue jumps back to FOR_ITER.
+	endPos := len(insts)
+	insts = append(insts, NewInst(POP_STACK))
 
-	endJump := len(bodyCode) + 3
-	insts = append(insts, NewInst("LIST_NEXT", &data.TorinoInt{endJump}))
-	insts = append(insts, NewInst("ASSIGN_NAME", &data.TorinoString{forNode.Symbol.Value}))
-	insts = append(insts, bodyCode...)
-	startJump := -(len(bodyCode) + 2)
-	insts = append(insts, NewInst("REL_JUMP", &data.TorinoInt{startJump}))
+	patchLoopJumps(insts, []*Instruction{nextInst}, endPos)
+	patchLoopJumps(insts, loop.breaks, endPos)
+	patchLoopJumps(insts, loop.continues, nextPos)
 	return insts, nil
 }
 
+func (cmp *Compiler) compileBreak(breakNode *parser.BreakNode) ([]*Instruction, error) {
+	if len(cmp.loops) == 0 {
+		return nil, errs.NewCompileError(
+			breakNode.Loc, errs.CODE_OUTSIDE_LOOP, "break outside of loop")
+	}
+
+	// The jump offset is filled in once the enclosing loop has been compiled.
+	inst := NewInst(REL_JUMP, 0)
+	loop := cmp.loops[len(cmp.loops)-1]
+	loop.breaks = append(loop.breaks, inst)
+	return []*Instruction{inst}, nil
+}
+
+func (cmp *Compiler) compileContinue(continueNode *parser.ContinueNode) ([]*Instruction, error) {
+	if len(cmp.loops) == 0 {
+		return nil, errs.NewCompileError(
+			continueNode.Loc, errs.CODE_OUTSIDE_LOOP, "continue outside of loop")
+	}
+
+	// The jump offset is filled in once the enclosing loop has been compiled.
+	inst := NewInst(REL_JUMP, 0)
+	loop := cmp.loops[len(cmp.loops)-1]
+	loop.continues = append(loop.continues, inst)
+	return []*Instruction{inst}, nil
+}
+
+func (cmp *Compiler) pushLoop() *loopInfo {
+	loop := &loopInfo{}
+	cmp.loops = append(cmp.loops, loop)
+	return loop
+}
+
+func (cmp *Compiler) popLoop() {
+	cmp.loops = cmp.loops[:len(cmp.loops)-1]
+}
+
+// Set the offsets of the jump instructions in `jumps`, all of which must occur in
+// `insts`, so that they jump to index `target` of `insts`.
+func patchLoopJumps(insts []*Instruction, jumps []*Instruction, target int) {
+	for _, jump := range jumps {
+		for i, inst := range insts {
+			if inst == jump {
+				inst.Args[0] = target - i
+				break
+			}
+		}
+	}
+}
+
 func (cmp *Compiler) compileList(listNode *parser.ListNode) ([]*Instruction, error) {
 	insts := []*Instruction{}
 	for i := len(listNode.Values) - 1; i >= 0; i-- {
@@ -236,7 +620,7 @@ func (cmp *Compiler) compileList(listNode *parser.ListNode) ([]*Instruction, err
 		insts = append(insts, exprCode...)
 	}
 
-	insts = append(insts, NewInst("MAKE_LIST", &data.TorinoInt{len(listNode.Values)}))
+	insts = append(insts, NewInst(MAKE_LIST, len(listNode.Values)))
 	return insts, nil
 }
 
@@ -256,11 +640,15 @@ func (cmp *Compiler) compileMap(mapNode *parser.MapNode) ([]*Instruction, error)
 		insts = append(insts, keyCode...)
 		insts = append(insts, valCode...)
 	}
-	insts = append(insts, NewInst("MAKE_MAP", &data.TorinoInt{len(mapNode.Values)}))
+	insts = append(insts, NewInst(MAKE_MAP, len(mapNode.Values)))
 	return insts, nil
 }
 
 func (cmp *Compiler) compileInfix(infixNode *parser.InfixNode) ([]*Instruction, error) {
+	if infixNode.Op == "and" || infixNode.Op == "or" {
+		return cmp.compileLogical(infixNode)
+	}
+
 	insts, err := cmp.compileExpression(infixNode.Right)
 	if err != nil {
 		return nil, err
@@ -272,30 +660,70 @@ func (cmp *Compiler) compileInfix(infixNode *parser.InfixNode) ([]*Instruction,
 	}
 
 	insts = append(insts, leftCode...)
-	if infixNode.Op == "+" {
-		return append(insts, NewInst("BINARY_ADD")), nil
-	} else if infixNode.Op == "-" {
-		return append(insts, NewInst("BINARY_SUB")), nil
-	} else if infixNode.Op == "*" {
-		return append(insts, NewInst("BINARY_MUL")), nil
-	} else if infixNode.Op == "/" {
-		return append(insts, NewInst("BINARY_DIV")), nil
-	} else if infixNode.Op == "==" {
-		return append(insts, NewInst("BINARY_EQ")), nil
-	} else if infixNode.Op == ">" {
-		return append(insts, NewInst("BINARY_GT")), nil
-	} else if infixNode.Op == "<" {
-		return append(insts, NewInst("BINARY_LT")), nil
-	} else if infixNode.Op == ">=" {
-		return append(insts, NewInst("BINARY_GE")), nil
-	} else if infixNode.Op == "<=" {
-		return append(insts, NewInst("BINARY_LE")), nil
-	} else if infixNode.Op == "and" {
-		return append(insts, NewInst("BINARY_AND")), nil
-	} else if infixNode.Op == "or" {
-		return append(insts, NewInst("BINARY_OR")), nil
+
+	opInst, err := binaryInstruction(infixNode.Op, infixNode.Loc)
+	if err != nil {
+		return nil, err
+	}
+	return append(insts, opInst), nil
+}
+
+// Compile `and` and `or` so that the right operand is only evaluated if the left
+// operand does not already determine the result.
+func (cmp *Compiler) compileLogical(infixNode *parser.InfixNode) ([]*Instruction, error) {
+	insts, err := cmp.compileExpression(infixNode.Left)
+	if err != nil {
+		return nil, err
+	}
+
+	rightCode, err := cmp.compileExpression(infixNode.Right)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the left operand decides the result, leave it on the stack and skip the
+	// right operand. Otherwise, pop it and evaluate the right operand instead.
+	jump := len(rightCode) + 1
+	if infixNode.Op == "and" {
+		insts = append(insts, NewInst(REL_JUMP_IF_FALSE_OR_POP, jump))
 	} else {
-		return nil, errors.New(fmt.Sprintf("unknown infix operator %s", infixNode.Op))
+		insts = append(insts, NewInst(REL_JUMP_IF_TRUE_OR_POP, jump))
+	}
+	return append(insts, rightCode...), nil
+}
+
+// Return the instruction that implements the given binary operator. The instruction
+// expects the left operand on top of the stack and the right operand beneath it.
+func binaryInstruction(op string, loc *lexer.Location) (*Instruction, error) {
+	if op == "+" {
+		return NewInst(BINARY_ADD), nil
+	} else if op == "-" {
+		return NewInst(BINARY_SUB), nil
+	} else if op == "*" {
+		return NewInst(BINARY_MUL), nil
+	} else if op == "/" {
+		return NewInst(BINARY_DIV), nil
+	} else if op == "//" {
+		return NewInst(BINARY_FLOOR_DIV), nil
+	} else if op == "%" {
+		return NewInst(BINARY_MOD), nil
+	} else if op == "==" {
+		return NewInst(BINARY_EQ), nil
+	} else if op == "!=" {
+		return NewInst(BINARY_NE), nil
+	} else if op == ">" {
+		return NewInst(BINARY_GT), nil
+	} else if op == "<" {
+		return NewInst(BINARY_LT), nil
+	} else if op == ">=" {
+		return NewInst(BINARY_GE), nil
+	} else if op == "<=" {
+		return NewInst(BINARY_LE), nil
+	} else if op == "in" {
+		return NewInst(BINARY_IN), nil
+	} else {
+		return nil, errs.NewCompileError(
+			loc, errs.CODE_INTERNAL, fmt.Sprintf("unknown infix operator %s", op))
 	}
 }
 
@@ -306,9 +734,12 @@ func (cmp *Compiler) compilePrefix(prefixNode *parser.PrefixNode) ([]*Instructio
 	}
 
 	if prefixNode.Op == "-" {
-		return append(insts, NewInst("UNARY_MINUS")), nil
+		return append(insts, NewInst(UNARY_MINUS)), nil
+	} else if prefixNode.Op == "not" {
+		return append(insts, NewInst(UNARY_NOT)), nil
 	} else {
-		return nil, errors.New(fmt.Sprintf("unknown prefix operator %s", prefixNode.Op))
+		return nil, errs.NewCompileError(prefixNode.Loc, errs.CODE_INTERNAL,
+			fmt.Sprintf("unknown prefix operator %s", prefixNode.Op))
 	}
 }
 
@@ -322,14 +753,27 @@ func (cmp *Compiler) compileCall(callNode *parser.CallNode) ([]*Instruction, err
 
 		insts = append(insts, exprCode...)
 	}
+	nargs := len(callNode.Arglist)
+
+	// Calling a method directly avoids creating a bound method object.
+	if attrNode, ok := callNode.Func.(*parser.AttrNode); ok {
+		selfCode, err := cmp.compileExpression(attrNode.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		insts = append(insts, selfCode...)
+		name := cmp.addName(attrNode.Attr.Value)
+		return append(insts, NewInst(CALL_METHOD, name, nargs)), nil
+	}
+
 	fCode, err := cmp.compileExpression(callNode.Func)
 	if err != nil {
 		return nil, err
 	}
 
 	insts = append(insts, fCode...)
-	nargs := len(callNode.Arglist)
-	insts = append(insts, NewInst("CALL_FUNCTION", &data.TorinoInt{nargs}))
+	insts = append(insts, NewInst(CALL_FUNCTION, nargs))
 	return insts, nil
 }
 
@@ -345,15 +789,36 @@ func (cmp *Compiler) compileIndex(indexNode *parser.IndexNode) ([]*Instruction,
 	}
 
 	insts = append(insts, indexedCode...)
-	return append(insts, NewInst("BINARY_INDEX")), nil
+	return append(insts, NewInst(BINARY_INDEX)), nil
 }
 
-// Some data types, defined here because they use the compiler.Instruction object,
-// which would create a circular import path if they were defined in the data
-// package.
+func (cmp *Compiler) compileAttr(attrNode *parser.AttrNode) ([]*Instruction, error) {
+	insts, err := cmp.compileExpression(attrNode.Value)
+	if err != nil {
+		return nil, err
+	}
+	return append(insts, NewInst(LOAD_ATTR, cmp.addName(attrNode.Attr.Value))), nil
+}
+
+// Some data types, defined here because they use compiled bytecode, which would
+// create a circular import path if they were defined in the data package.
 
+// A unit of compiled bytecode, e.g. a program or the body of a function.
 type TorinoCode struct {
-	Code []*Instruction
+	// The encoded instructions. Each opcode is followed by its operands.
+	Code []uint32
+	// The values referred to by constant operands.
+	Constants []data.TorinoValue
+	// The global variable and attribute names referred to by name operands.
+	Names []string
+	// The names of the local variables, indexed by slot.
+	LocalNames []string
+	// The variables of enclosing functions that the code refers to, for the body of
+	// a nested function.
+	Upvalues []Upvalue
+	// The source location of each instruction, indexed by the offset of its opcode
+	// in Code. Entries for operands are nil.
+	Locs []*lexer.Location
 }
 
 func (t *TorinoCode) Torino() {}
@@ -366,17 +831,77 @@ func (t *TorinoCode) Repr() string {
 	return t.String()
 }
 
+func (t *TorinoCode) TypeName() string {
+	return "code"
+}
+
+// A variable of an enclosing function that a closure captures.
+type Upvalue struct {
+	Name string
+	// If true, Index is a local variable slot of the function that creates the
+	// closure. Otherwise, it is an index into that function's own upvalues.
+	IsLocal bool
+	Index   int
+}
+
+// A compiled function. At runtime, functions are called through closures, which are
+// created by the MAKE_CLOSURE instruction.
 type TorinoFunction struct {
-	Params []*parser.SymbolNode
-	Body   []*Instruction
+	Name   string
+	Params []string
+	Body   *TorinoCode
 }
 
 func (t *TorinoFunction) Torino() {}
 
 func (t *TorinoFunction) String() string {
-	return "<function object>"
+	return fmt.Sprintf("<function %s>", t.Name)
 }
 
 func (t *TorinoFunction) Repr() string {
 	return t.String()
 }
+
+func (t *TorinoFunction) TypeName() string {
+	return "function"
+}
+
+// A function together with the variables it captured when it was created.
+type TorinoClosure struct {
+	Function *TorinoFunction
+	Upvalues []*TorinoCell
+}
+
+func (t *TorinoClosure) Torino() {}
+
+func (t *TorinoClosure) String() string {
+	return t.Function.String()
+}
+
+func (t *TorinoClosure) Repr() string {
+	return t.String()
+}
+
+func (t *TorinoClosure) TypeName() string {
+	return "function"
+}
+
+// A variable that has been captured by a closure. Both the function that declares
+// the variable and the closures that capture it refer to the same cell.
+type TorinoCell struct {
+	Value data.TorinoValue
+}
+
+func (t *TorinoCell) Torino() {}
+
+func (t *TorinoCell) String() string {
+	return "<cell>"
+}
+
+func (t *TorinoCell) Repr() string {
+	return t.String()
+}
+
+func (t *TorinoCell) TypeName() string {
+	return "cell"
+}
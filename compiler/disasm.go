@@ -0,0 +1,68 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Return a human-readable listing of the instructions of a code object and of the
+// bodies of any functions that it defines.
+//
+// Each instruction is printed on its own line with its source line (when it differs
+// from the previous instruction's), its offset, its opcode and its operands.
+// Constant, name and local variable operands are followed by the value or name they
+// refer to, and jump operands by the offset they jump to.
+func Disassemble(code *TorinoCode) string {
+	var sb strings.Builder
+	disassemble(&sb, "<program>", code)
+	return sb.String()
+}
+
+func disassemble(sb *strings.Builder, name string, code *TorinoCode) {
+	sb.WriteString(fmt.Sprintf("Disassembly of %s:\n", name))
+
+	lastLine := 0
+	for pc := 0; pc < len(code.Code); {
+		op := Opcode(code.Code[pc])
+
+		line := ""
+		if loc := code.Locs[pc]; loc != nil && loc.Line != lastLine {
+			line = fmt.Sprintf("%d", loc.Line)
+			lastLine = loc.Line
+		}
+
+		operands := []string{}
+		for i, kind := range op.Operands() {
+			operands = append(operands, disassembleOperand(code, pc, kind, code.Code[pc+1+i]))
+		}
+
+		sb.WriteString(strings.TrimRight(fmt.Sprintf(
+			"%4s %6d  %-26s%s", line, pc, op, strings.Join(operands, ", ")), " "))
+		sb.WriteString("\n")
+		pc += op.Width()
+	}
+
+	for _, val := range code.Constants {
+		if f, ok := val.(*TorinoFunction); ok {
+			sb.WriteString("\n")
+			disassemble(sb, f.Name, f.Body)
+		}
+	}
+}
+
+func disassembleOperand(code *TorinoCode, pc int, kind OperandKind, operand uint32) string {
+	if kind == OPERAND_CONST {
+		return fmt.Sprintf("%d (%s)", operand, code.Constants[operand].Repr())
+	} else if kind == OPERAND_NAME {
+		return fmt.Sprintf("%d (%s)", operand, code.Names[operand])
+	} else if kind == OPERAND_LOCAL {
+		return fmt.Sprintf("%d (%s)", operand, code.LocalNames[operand])
+	} else if kind == OPERAND_UPVALUE {
+		return fmt.Sprintf("%d (%s)", operand, code.Upvalues[operand].Name)
+	} else if kind == OPERAND_JUMP {
+		offset := int(int32(operand))
+		return fmt.Sprintf("%+d (to %d)", offset, pc+offset)
+	} else {
+		return fmt.Sprintf("%d", operand)
+	}
+}
@@ -0,0 +1,495 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/iafisher/torino/data"
+	"github.com/iafisher/torino/lexer"
+	"hash/crc32"
+)
+
+// The binary format of a compiled module is a header followed by a payload. The
+// header consists of the magic bytes, the format version, the length of the payload
+// and its CRC-32 checksum. The payload holds the path of the source file and the
+// top-level code object. A code object is encoded as its instructions, its constant
+// pool (in which functions are nested code objects), its name table, the names of
+// its local variables, its upvalues, and its line table, which lists the offset and
+// source location of every located instruction.
+//
+// All integers are little-endian. Strings are encoded as their length followed by
+// their bytes.
+
+const MODULE_MAGIC = "TNOC"
+
+// The version of the format, to be incremented whenever the format or the meaning
+// of any opcode changes.
+const MODULE_VERSION = 3
+
+const (
+	CONST_INT      = 'i'
+	CONST_STRING   = 's'
+	CONST_BOOL     = 'b'
+	CONST_NONE     = 'n'
+	CONST_FUNCTION = 'f'
+)
+
+// A compiled program that can be written to and read from a .tnoc file.
+type Module struct {
+	// The path of the source file that the module was compiled from.
+	Source string
+	Code   *TorinoCode
+}
+
+func (m *Module) Encode() ([]byte, error) {
+	var payload bytes.Buffer
+	writeString(&payload, m.Source)
+	err := writeCode(&payload, m.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.WriteString(MODULE_MAGIC)
+	writeUint32(&out, MODULE_VERSION)
+	writeUint32(&out, uint32(payload.Len()))
+	writeUint32(&out, crc32.ChecksumIEEE(payload.Bytes()))
+	out.Write(payload.Bytes())
+	return out.Bytes(), nil
+}
+
+func writeCode(buf *bytes.Buffer, code *TorinoCode) error {
+	writeUint32(buf, uint32(len(code.Code)))
+	for _, word := range code.Code {
+		writeUint32(buf, word)
+	}
+
+	writeUint32(buf, uint32(len(code.Constants)))
+	for _, val := range code.Constants {
+		switch v := val.(type) {
+		case *data.TorinoInt:
+			buf.WriteByte(CONST_INT)
+			writeUint64(buf, uint64(int64(v.Value)))
+		case *data.TorinoString:
+			buf.WriteByte(CONST_STRING)
+			writeString(buf, v.Value)
+		case *data.TorinoBool:
+			buf.WriteByte(CONST_BOOL)
+			if v.Value {
+				buf.WriteByte(1)
+			} else {
+				buf.WriteByte(0)
+			}
+		case *data.TorinoNone:
+			buf.WriteByte(CONST_NONE)
+		case *TorinoFunction:
+			buf.WriteByte(CONST_FUNCTION)
+			writeString(buf, v.Name)
+			writeUint32(buf, uint32(len(v.Params)))
+			for _, param := range v.Params {
+				writeString(buf, param)
+			}
+
+			err := writeCode(buf, v.Body)
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.New(fmt.Sprintf("cannot serialize constant of type %s", val.TypeName()))
+		}
+	}
+
+	writeUint32(buf, uint32(len(code.Names)))
+	for _, name := range code.Names {
+		writeString(buf, name)
+	}
+
+	writeUint32(buf, uint32(len(code.LocalNames)))
+	for _, name := range code.LocalNames {
+		writeString(buf, name)
+	}
+
+	writeUint32(buf, uint32(len(code.Upvalues)))
+	for _, upvalue := range code.Upvalues {
+		writeString(buf, upvalue.Name)
+		if upvalue.IsLocal {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		writeUint32(buf, uint32(upvalue.Index))
+	}
+
+	nlocs := 0
+	for _, loc := range code.Locs {
+		if loc != nil {
+			nlocs += 1
+		}
+	}
+
+	writeUint32(buf, uint32(nlocs))
+	for offset, loc := range code.Locs {
+		if loc != nil {
+			writeUint32(buf, uint32(offset))
+			writeUint32(buf, uint32(loc.Line))
+			writeUint32(buf, uint32(loc.Column))
+		}
+	}
+	return nil
+}
+
+func writeUint32(buf *bytes.Buffer, n uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], n)
+	buf.Write(b[:])
+}
+
+func writeUint64(buf *bytes.Buffer, n uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], n)
+	buf.Write(b[:])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUint32(buf, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+// Decode a module from the contents of a .tnoc file. The header is checked before
+// anything else is decoded, and the decoded bytecode is validated: its operands
+// must refer to things that exist and it must never pop more values off the stack
+// than it pushed. The types of the values on the stack are not checked; the
+// virtual machine reports a runtime error for those.
+func DecodeModule(b []byte) (*Module, error) {
+	if len(b) < len(MODULE_MAGIC)+12 || string(b[:len(MODULE_MAGIC)]) != MODULE_MAGIC {
+		return nil, errors.New("not a compiled Torino module")
+	}
+
+	header := b[len(MODULE_MAGIC):]
+	version := binary.LittleEndian.Uint32(header[0:4])
+	if version != MODULE_VERSION {
+		return nil, errors.New(fmt.Sprintf(
+			"unsupported module version %d (expected %d)", version, MODULE_VERSION))
+	}
+
+	length := binary.LittleEndian.Uint32(header[4:8])
+	checksum := binary.LittleEndian.Uint32(header[8:12])
+	payload := header[12:]
+	if uint32(len(payload)) != length || crc32.ChecksumIEEE(payload) != checksum {
+		return nil, errors.New("module checksum does not match: the file is corrupted")
+	}
+
+	r := &moduleReader{payload, nil}
+	source := r.readString()
+	code := r.readCode()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if len(r.b) != 0 {
+		return nil, errors.New("unexpected data at end of module")
+	}
+
+	// The program is not a closure, so there is nothing for it to capture.
+	if len(code.Upvalues) != 0 {
+		return nil, errors.New("program cannot have upvalues")
+	}
+	return &Module{source, code}, nil
+}
+
+// A cursor over an encoded payload. Once an error occurs, all reads return zero
+// values and the first error is kept.
+type moduleReader struct {
+	b   []byte
+	err error
+}
+
+func (r *moduleReader) fail(msg string) {
+	if r.err == nil {
+		r.err = errors.New(msg)
+	}
+	r.b = nil
+}
+
+func (r *moduleReader) readBytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(r.b) {
+		r.fail("module is truncated")
+		return nil
+	}
+	ret := r.b[:n]
+	r.b = r.b[n:]
+	return ret
+}
+
+func (r *moduleReader) readByte() byte {
+	b := r.readBytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *moduleReader) readUint32() uint32 {
+	b := r.readBytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *moduleReader) readUint64() uint64 {
+	b := r.readBytes(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (r *moduleReader) readString() string {
+	n := r.readUint32()
+	return string(r.readBytes(int(n)))
+}
+
+func (r *moduleReader) readCode() *TorinoCode {
+	n := int(r.readUint32())
+	if n > len(r.b)/4 {
+		r.fail("module is truncated")
+		return nil
+	}
+
+	code := &TorinoCode{make([]uint32, n), []data.TorinoValue{}, []string{}, []string{}, nil, nil}
+	for i := 0; i < n; i++ {
+		code.Code[i] = r.readUint32()
+	}
+
+	nconsts := int(r.readUint32())
+	for i := 0; i < nconsts && r.err == nil; i++ {
+		code.Constants = append(code.Constants, r.readConstant())
+	}
+
+	nnames := int(r.readUint32())
+	for i := 0; i < nnames && r.err == nil; i++ {
+		code.Names = append(code.Names, r.readString())
+	}
+
+	nlocals := int(r.readUint32())
+	for i := 0; i < nlocals && r.err == nil; i++ {
+		code.LocalNames = append(code.LocalNames, r.readString())
+	}
+
+	nupvalues := int(r.readUint32())
+	for i := 0; i < nupvalues && r.err == nil; i++ {
+		name := r.readString()
+		isLocal := r.readByte() != 0
+		index := int(r.readUint32())
+		code.Upvalues = append(code.Upvalues, Upvalue{name, isLocal, index})
+	}
+
+	code.Locs = make([]*lexer.Location, n)
+	nlocs := int(r.readUint32())
+	for i := 0; i < nlocs && r.err == nil; i++ {
+		offset := int(r.readUint32())
+		line := int(r.readUint32())
+		column := int(r.readUint32())
+		if offset >= n {
+			r.fail("line table refers to a nonexistent instruction")
+			return nil
+		}
+		code.Locs[offset] = &lexer.Location{line, column}
+	}
+
+	if r.err != nil {
+		return nil
+	}
+
+	err := validateCode(code)
+	if err != nil {
+		r.fail(err.Error())
+		return nil
+	}
+	return code
+}
+
+func (r *moduleReader) readConstant() data.TorinoValue {
+	tag := r.readByte()
+	switch tag {
+	case CONST_INT:
+		return &data.TorinoInt{int(int64(r.readUint64()))}
+	case CONST_STRING:
+		return &data.TorinoString{r.readString()}
+	case CONST_BOOL:
+		return &data.TorinoBool{r.readByte() != 0}
+	case CONST_NONE:
+		return &data.TorinoNone{}
+	case CONST_FUNCTION:
+		name := r.readString()
+		nparams := int(r.readUint32())
+		params := []string{}
+		for i := 0; i < nparams && r.err == nil; i++ {
+			params = append(params, r.readString())
+		}
+		return &TorinoFunction{name, params, r.readCode()}
+	default:
+		r.fail(fmt.Sprintf("unknown constant tag %q", tag))
+		return nil
+	}
+}
+
+// Check that every instruction in the code object has a known opcode and operands
+// that refer to existing constants, names, local variables, upvalues and
+// instructions, and that closures capture only variables that exist.
+func validateCode(code *TorinoCode) error {
+	// First find where each instruction starts, so that jump targets can be checked.
+	starts := map[int]bool{len(code.Code): true}
+	for pc := 0; pc < len(code.Code); {
+		op := Opcode(code.Code[pc])
+		if int(op) >= len(opcodeTable) {
+			return errors.New(fmt.Sprintf("unknown opcode %d at offset %d", op, pc))
+		}
+
+		starts[pc] = true
+		pc += op.Width()
+		if pc > len(code.Code) {
+			return errors.New("last instruction is missing its operands")
+		}
+	}
+
+	for pc := 0; pc < len(code.Code); {
+		op := Opcode(code.Code[pc])
+		for i, kind := range op.Operands() {
+			operand := code.Code[pc+1+i]
+			if kind == OPERAND_CONST && int(operand) >= len(code.Constants) {
+				return errors.New(fmt.Sprintf("invalid constant index at offset %d", pc))
+			} else if kind == OPERAND_NAME && int(operand) >= len(code.Names) {
+				return errors.New(fmt.Sprintf("invalid name index at offset %d", pc))
+			} else if kind == OPERAND_LOCAL && int(operand) >= len(code.LocalNames) {
+				return errors.New(fmt.Sprintf("invalid local variable slot at offset %d", pc))
+			} else if kind == OPERAND_UPVALUE && int(operand) >= len(code.Upvalues) {
+				return errors.New(fmt.Sprintf("invalid upvalue index at offset %d", pc))
+			} else if kind == OPERAND_JUMP && !starts[pc+int(int32(operand))] {
+				return errors.New(fmt.Sprintf("invalid jump target at offset %d", pc))
+			}
+		}
+
+		if op == MAKE_CLOSURE {
+			err := validateClosure(code, code.Constants[code.Code[pc+1]])
+			if err != nil {
+				return errors.New(fmt.Sprintf("%s at offset %d", err, pc))
+			}
+		}
+		pc += op.Width()
+	}
+	return validateStack(code)
+}
+
+// Check that no instruction pops more values than its frame has pushed, and that
+// every path to an instruction reaches it with the same number of values on the
+// stack, by following every path through the code from its start. The code's
+// operands must already have been checked.
+func validateStack(code *TorinoCode) error {
+	depths := map[int]int{0: 0}
+	pending := []int{0}
+	for len(pending) > 0 {
+		pc := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if pc == len(code.Code) {
+			continue
+		}
+
+		op := Opcode(code.Code[pc])
+		pops, pushes, jumpPushes := stackEffect(code, pc)
+		depth := depths[pc]
+		if depth < pops {
+			return errors.New(fmt.Sprintf("stack underflow at offset %d", pc))
+		}
+
+		successors := map[int]int{}
+		if op != REL_JUMP && op != RETURN_VALUE {
+			successors[pc+op.Width()] = depth - pops + pushes
+		}
+		if jumpPushes >= 0 {
+			successors[pc+int(int32(code.Code[pc+1]))] = depth - pops + jumpPushes
+		}
+
+		for next, nextDepth := range successors {
+			if existing, ok := depths[next]; !ok {
+				depths[next] = nextDepth
+				pending = append(pending, next)
+			} else if existing != nextDepth {
+				return errors.New(fmt.Sprintf("inconsistent stack depth at offset %d", next))
+			}
+		}
+	}
+	return nil
+}
+
+// Return the number of values that the instruction at `pc` pops off the stack, the
+// number that it pushes when execution continues with the next instruction, and the
+// number that it pushes when it jumps, or -1 if it never jumps.
+func stackEffect(code *TorinoCode, pc int) (int, int, int) {
+	op := Opcode(code.Code[pc])
+	switch op {
+	case PUSH_CONST, LOAD_LOCAL, LOAD_CELL, LOAD_UPVALUE, LOAD_GLOBAL, MAKE_CLOSURE:
+		return 0, 1, -1
+	case STORE_LOCAL, STORE_CELL, DEFINE_CELL, STORE_UPVALUE, DEFINE_GLOBAL, STORE_GLOBAL, POP_STACK:
+		return 1, 0, -1
+	case DUP_TOP_TWO:
+		return 2, 4, -1
+	case ROT_TWO:
+		return 2, 2, -1
+	case STORE_INDEX:
+		return 3, 0, -1
+	case UNARY_MINUS, UNARY_NOT, LOAD_ATTR, GET_ITER:
+		return 1, 1, -1
+	case CALL_FUNCTION:
+		return int(code.Code[pc+1]) + 1, 1, -1
+	case CALL_METHOD:
+		return int(code.Code[pc+2]) + 1, 1, -1
+	case RETURN_VALUE:
+		return 1, 0, -1
+	case MAKE_LIST:
+		return int(code.Code[pc+1]), 1, -1
+	case MAKE_MAP:
+		return 2 * int(code.Code[pc+1]), 1, -1
+	case FOR_ITER:
+		// The iterator stays on the stack, with the next value on top of it if there
+		// is one.
+		return 1, 2, 1
+	case UNPACK_SEQUENCE:
+		return 1, int(code.Code[pc+1]), -1
+	case REL_JUMP:
+		return 0, 0, 0
+	case REL_JUMP_IF_FALSE:
+		return 1, 0, 0
+	case REL_JUMP_IF_FALSE_OR_POP, REL_JUMP_IF_TRUE_OR_POP:
+		return 1, 0, 1
+	default:
+		// The binary operators.
+		return 2, 1, -1
+	}
+}
+
+func validateClosure(code *TorinoCode, val data.TorinoValue) error {
+	f, ok := val.(*TorinoFunction)
+	if !ok {
+		return errors.New("closure of non-function constant")
+	}
+
+	if len(f.Params) > len(f.Body.LocalNames) {
+		return errors.New("function has more parameters than local variables")
+	}
+
+	for _, upvalue := range f.Body.Upvalues {
+		if upvalue.IsLocal && upvalue.Index >= len(code.LocalNames) {
+			return errors.New("closure captures invalid local variable slot")
+		} else if !upvalue.IsLocal && upvalue.Index >= len(code.Upvalues) {
+			return errors.New("closure captures invalid upvalue")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/iafisher/torino/errs"
+	"github.com/iafisher/torino/parser"
+)
+
+// Where a variable is stored at runtime.
+type bindingKind int
+
+const (
+	// A variable declared at the top level of the program, or a builtin. Globals are
+	// looked up by name in the environment.
+	BINDING_GLOBAL bindingKind = iota
+	// A variable declared inside a function or a block. Locals are stored in
+	// numbered slots in the call frame.
+	BINDING_LOCAL
+	// A local variable of an enclosing function, which the closure captures.
+	BINDING_UPVALUE
+)
+
+type binding struct {
+	kind bindingKind
+	// The slot of a local variable, or the index of an upvalue.
+	slot int
+}
+
+// The result of resolving a program: the binding of every variable reference and
+// declaration, and the scopes of the program and of each function.
+type resolution struct {
+	bindings map[*parser.SymbolNode]binding
+	// Keyed by the block that forms the body of the code object.
+	scopes map[*parser.BlockNode]*funcScope
+}
+
+// The resolver walks the AST before any code is generated and decides where each
+// variable is stored. Names declared at the top level of the program are globals;
+// all other names are locals of the enclosing function (or of the program, for
+// blocks at the top level) and are assigned numbered slots. Each block opens a new
+// scope, so that a name may be redeclared in a nested block, shadowing the outer
+// declaration until the end of the block. A nested function may refer to the locals
+// of the functions that enclose it, which it captures as upvalues.
+type resolver struct {
+	// The names of the global variables that are already defined in the environment.
+	globals map[string]bool
+	// The globals that the program declares anywhere at its top level. Functions may
+	// refer to them even if they are declared later in the program, since a function
+	// is not run until it is called.
+	later map[string]bool
+	// The globals that the program has declared so far, in source order, which are
+	// all that the top level of the program may refer to. They are also used to
+	// detect redefinitions.
+	declared map[string]bool
+	// The function currently being resolved, or the program itself.
+	fn     *funcScope
+	result *resolution
+}
+
+// The scopes of a function or of the top-level program.
+type funcScope struct {
+	// The function that the function is nested in, or nil for the program.
+	enclosing *funcScope
+	// The block scopes enclosing the current node, innermost last. Each maps a
+	// name to its slot. When resolving the top level of the program, there are no
+	// block scopes and declarations are global.
+	blocks []map[string]int
+	// The names of the local variables, indexed by slot. Slots are never reused, so
+	// a name appears more than once if it is shadowed.
+	locals []string
+	// Whether each local variable is captured by a nested function. Captured
+	// variables are stored in cells that are shared with the closures that capture
+	// them.
+	captured []bool
+	// The variables of enclosing functions that the function refers to.
+	upvalues []Upvalue
+}
+
+// Resolve the variables of a top-level program. `globals` are the names of the
+// variables that are already defined in the environment the program will run in.
+func resolve(ast *parser.BlockNode, globals []string) (*resolution, error) {
+	r := &resolver{
+		map[string]bool{},
+		map[string]bool{},
+		map[string]bool{},
+		&funcScope{},
+		&resolution{map[*parser.SymbolNode]binding{}, map[*parser.BlockNode]*funcScope{}},
+	}
+
+	for _, name := range globals {
+		r.globals[name] = true
+	}
+
+	for _, stmt := range ast.Statements {
+		switch v := stmt.(type) {
+		case *parser.LetNode:
+			r.later[v.Destination.Value] = true
+		case *parser.FnNode:
+			r.later[v.Symbol.Value] = true
+		}
+	}
+
+	for _, stmt := range ast.Statements {
+		err := r.resolveStatement(stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.result.scopes[ast] = r.fn
+	return r.result, nil
+}
+
+// Resolve the statements of a block in a new scope.
+func (r *resolver) resolveBlock(block *parser.BlockNode) error {
+	r.fn.blocks = append(r.fn.blocks, map[string]int{})
+	defer r.popScope()
+
+	for _, stmt := range block.Statements {
+		err := r.resolveStatement(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *resolver) popScope() {
+	r.fn.blocks = r.fn.blocks[:len(r.fn.blocks)-1]
+}
+
+func (r *resolver) resolveStatement(stmt parser.Statement) error {
+	switch v := stmt.(type) {
+	case *parser.ExpressionStatement:
+		return r.resolveExpression(v.Expr)
+	case *parser.LetNode:
+		// The value is resolved first, so that it refers to any outer variable of the
+		// same name rather than to the one being declared.
+		err := r.resolveExpression(v.Value)
+		if err != nil {
+			return err
+		}
+		return r.declare(v.Destination)
+	case *parser.AssignNode:
+		err := r.resolveExpression(v.Value)
+		if err != nil {
+			return err
+		}
+		return r.resolveSymbol(v.Destination)
+	case *parser.IndexAssignNode:
+		return r.resolveExpressions(v.Index, v.Indexed, v.Value)
+	case *parser.CompoundAssignNode:
+		return r.resolveExpressions(v.Value, v.Destination)
+	case *parser.IfNode:
+		for _, clause := range v.Clauses {
+			err := r.resolveExpression(clause.Cond)
+			if err != nil {
+				return err
+			}
+
+			err = r.resolveBlock(clause.Body)
+			if err != nil {
+				return err
+			}
+		}
+
+		if v.Else != nil {
+			return r.resolveBlock(v.Else)
+		}
+		return nil
+	case *parser.FnNode:
+		// The function is declared before its body is resolved, so that it can call
+		// itself.
+		err := r.declare(v.Symbol)
+		if err != nil {
+			return err
+		}
+		return r.resolveFunction(v.Params, v.Body)
+	case *parser.ReturnNode:
+		if v.Value == nil {
+			return nil
+		}
+		return r.resolveExpression(v.Value)
+	case *parser.WhileNode:
+		err := r.resolveExpression(v.Cond)
+		if err != nil {
+			return err
+		}
+		return r.resolveBlock(v.Block)
+	case *parser.ForNode:
+		err := r.resolveExpression(v.Iter)
+		if err != nil {
+			return err
+		}
+
+		// The loop variables are scoped to the loop, and the body is a nested scope.
+		r.fn.blocks = append(r.fn.blocks, map[string]int{})
+		defer r.popScope()
+		for _, sym := range v.Symbols {
+			err := r.declare(sym)
+			if err != nil {
+				return err
+			}
+		}
+		return r.resolveBlock(v.Block)
+	case *parser.BreakNode, *parser.ContinueNode:
+		return nil
+	default:
+		return errs.NewCompileError(
+			stmt.Location(), errs.CODE_INTERNAL, fmt.Sprintf("unknown statement type %T", stmt))
+	}
+}
+
+func (r *resolver) resolveFunction(params []*parser.SymbolNode, body *parser.BlockNode) error {
+	// The parameters occupy the first slots of the function's frame, and share a
+	// scope with the top level of the body.
+	enclosing := r.fn
+	r.fn = &funcScope{enclosing, []map[string]int{{}}, nil, nil, nil}
+	defer func() { r.fn = enclosing }()
+
+	for _, param := range params {
+		err := r.declare(param)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range body.Statements {
+		err := r.resolveStatement(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.result.scopes[body] = r.fn
+	return nil
+}
+
+func (r *resolver) resolveExpressions(exprs ...parser.Expression) error {
+	for _, expr := range exprs {
+		err := r.resolveExpression(expr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *resolver) resolveExpression(expr parser.Expression) error {
+	switch v := expr.(type) {
+	case *parser.SymbolNode:
+		return r.resolveSymbol(v)
+	case *parser.IntegerNode, *parser.BoolNode, *parser.StringNode, *parser.NoneNode:
+		return nil
+	case *parser.ListNode:
+		return r.resolveExpressions(v.Values...)
+	case *parser.MapNode:
+		for _, item := range v.Values {
+			err := r.resolveExpressions(item.Key, item.Value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case *parser.InfixNode:
+		return r.resolveExpressions(v.Left, v.Right)
+	case *parser.PrefixNode:
+		return r.resolveExpression(v.Arg)
+	case *parser.CallNode:
+		err := r.resolveExpressions(v.Arglist...)
+		if err != nil {
+			return err
+		}
+		return r.resolveExpression(v.Func)
+	case *parser.IndexNode:
+		return r.resolveExpressions(v.Index, v.Indexed)
+	case *parser.AttrNode:
+		// The attribute is a method name, not a variable.
+		return r.resolveExpression(v.Value)
+	case *parser.FnExpressionNode:
+		return r.resolveFunction(v.Params, v.Body)
+	default:
+		return errs.NewCompileError(expr.Location(), errs.CODE_INTERNAL,
+			fmt.Sprintf("unknown expression type %+v (%T)", expr, expr))
+	}
+}
+
+// Declare a new variable in the innermost scope.
+func (r *resolver) declare(sym *parser.SymbolNode) error {
+	if r.fn.enclosing == nil && len(r.fn.blocks) == 0 {
+		if r.declared[sym.Value] {
+			return errs.NewCompileError(sym.Loc, errs.CODE_REDEFINITION,
+				fmt.Sprintf("cannot redefine symbol %s", sym.Value))
+		}
+
+		r.declared[sym.Value] = true
+		r.result.bindings[sym] = binding{BINDING_GLOBAL, 0}
+		return nil
+	}
+
+	scope := r.fn.blocks[len(r.fn.blocks)-1]
+	if _, ok := scope[sym.Value]; ok {
+		return errs.NewCompileError(sym.Loc, errs.CODE_REDEFINITION,
+			fmt.Sprintf("cannot redefine symbol %s", sym.Value))
+	}
+
+	slot := len(r.fn.locals)
+	r.fn.locals = append(r.fn.locals, sym.Value)
+	r.fn.captured = append(r.fn.captured, false)
+	scope[sym.Value] = slot
+	r.result.bindings[sym] = binding{BINDING_LOCAL, slot}
+	return nil
+}
+
+// Resolve a reference to an existing variable, searching the scopes of the current
+// function from the innermost outward, then the scopes of the enclosing functions,
+// and then the globals.
+func (r *resolver) resolveSymbol(sym *parser.SymbolNode) error {
+	if slot, ok := r.fn.lookup(sym.Value); ok {
+		r.result.bindings[sym] = binding{BINDING_LOCAL, slot}
+		return nil
+	}
+
+	if index, ok := r.fn.capture(sym.Value); ok {
+		r.result.bindings[sym] = binding{BINDING_UPVALUE, index}
+		return nil
+	}
+
+	inFunction := r.fn.enclosing != nil
+	if r.globals[sym.Value] || r.declared[sym.Value] || (inFunction && r.later[sym.Value]) {
+		r.result.bindings[sym] = binding{BINDING_GLOBAL, 0}
+		return nil
+	}
+
+	return errs.NewCompileError(
+		sym.Loc, errs.CODE_UNDEFINED_NAME, fmt.Sprintf("undefined symbol %s", sym.Value))
+}
+
+// Return the slot of the local variable visible under `name`.
+func (fn *funcScope) lookup(name string) (int, bool) {
+	for i := len(fn.blocks) - 1; i >= 0; i-- {
+		if slot, ok := fn.blocks[i][name]; ok {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+// Return the index of the upvalue for the variable of an enclosing function that is
+// visible under `name`, adding the upvalue to this function and to any functions in
+// between if needed.
+func (fn *funcScope) capture(name string) (int, bool) {
+	if fn.enclosing == nil {
+		return 0, false
+	}
+
+	if slot, ok := fn.enclosing.lookup(name); ok {
+		fn.enclosing.captured[slot] = true
+		return fn.addUpvalue(Upvalue{name, true, slot}), true
+	}
+
+	if index, ok := fn.enclosing.capture(name); ok {
+		return fn.addUpvalue(Upvalue{name, false, index}), true
+	}
+	return 0, false
+}
+
+func (fn *funcScope) addUpvalue(upvalue Upvalue) int {
+	for i, existing := range fn.upvalues {
+		if existing == upvalue {
+			return i
+		}
+	}
+
+	fn.upvalues = append(fn.upvalues, upvalue)
+	return len(fn.upvalues) - 1
+}
@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 type TorinoValue interface {
 	String() string
 	Repr() string
+	// The name of the value's type, for use in error messages.
+	TypeName() string
 	Torino()
 }
 
@@ -24,6 +27,10 @@ func (t *TorinoInt) Repr() string {
 	return t.String()
 }
 
+func (t *TorinoInt) TypeName() string {
+	return "int"
+}
+
 func (t *TorinoInt) Torino() {}
 
 type TorinoString struct {
@@ -38,6 +45,33 @@ func (t *TorinoString) Repr() string {
 	return strconv.Quote(t.Value)
 }
 
+func (t *TorinoString) TypeName() string {
+	return "string"
+}
+
+// Return the number of characters in the string. As in Iter, each byte that is not
+// valid UTF-8 counts as a character.
+func (t *TorinoString) Len() int {
+	return utf8.RuneCountInString(t.Value)
+}
+
+// Return the character at index `i`, counting characters as Len does.
+func (t *TorinoString) Char(i int) (*TorinoString, bool) {
+	if i < 0 {
+		return nil, false
+	}
+
+	for start := 0; start < len(t.Value); {
+		_, size := utf8.DecodeRuneInString(t.Value[start:])
+		if i == 0 {
+			return &TorinoString{t.Value[start : start+size]}, true
+		}
+		i -= 1
+		start += size
+	}
+	return nil, false
+}
+
 func (t *TorinoString) Torino() {}
 
 type TorinoBool struct {
@@ -56,6 +90,10 @@ func (t *TorinoBool) Repr() string {
 	return t.String()
 }
 
+func (t *TorinoBool) TypeName() string {
+	return "bool"
+}
+
 func (t *TorinoBool) Torino() {}
 
 type TorinoNone struct {
@@ -71,6 +109,10 @@ func (t *TorinoNone) Repr() string {
 	return t.String()
 }
 
+func (t *TorinoNone) TypeName() string {
+	return "none"
+}
+
 type TorinoBuiltin struct {
 	F func(...TorinoValue) (TorinoValue, error)
 }
@@ -85,6 +127,10 @@ func (t *TorinoBuiltin) Repr() string {
 	return t.String()
 }
 
+func (t *TorinoBuiltin) TypeName() string {
+	return "builtin"
+}
+
 type TorinoList struct {
 	Values []TorinoValue
 }
@@ -92,11 +138,21 @@ type TorinoList struct {
 func (t *TorinoList) Torino() {}
 
 func (t *TorinoList) String() string {
+	return t.repr(map[TorinoValue]bool{})
+}
+
+func (t *TorinoList) repr(seen map[TorinoValue]bool) string {
+	if seen[t] {
+		return "[...]"
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
 	var str strings.Builder
 
 	str.WriteString("[")
 	for i, val := range t.Values {
-		str.WriteString(val.Repr())
+		str.WriteString(reprNested(val, seen))
 		if i != len(t.Values)-1 {
 			str.WriteString(", ")
 		}
@@ -109,28 +165,46 @@ func (t *TorinoList) Repr() string {
 	return t.String()
 }
 
+func (t *TorinoList) TypeName() string {
+	return "list"
+}
+
 type TorinoMap struct {
 	// Keys are stored as their repr value, which is hacky but simple and allows
 	// any TorinoValue to be a key.
 	Values map[string]TorinoValue
+	// The original keys, in insertion order.
+	Keys []TorinoValue
+}
+
+func NewMap() *TorinoMap {
+	return &TorinoMap{map[string]TorinoValue{}, nil}
 }
 
 func (t *TorinoMap) Torino() {}
 
 func (t *TorinoMap) String() string {
+	return t.repr(map[TorinoValue]bool{})
+}
+
+func (t *TorinoMap) repr(seen map[TorinoValue]bool) string {
+	if seen[t] {
+		return "{...}"
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
 	var str strings.Builder
 
 	str.WriteString("{")
-	i := 0
-	for key, val := range t.Values {
-		str.WriteString(key)
+	for i, key := range t.Keys {
+		str.WriteString(reprNested(key, seen))
 		str.WriteString(": ")
-		str.WriteString(val.Repr())
+		str.WriteString(reprNested(t.Values[key.Repr()], seen))
 
-		if i != len(t.Values)-1 {
+		if i != len(t.Keys)-1 {
 			str.WriteString(", ")
 		}
-		i += 1
 	}
 	str.WriteString("}")
 	return str.String()
@@ -140,11 +214,99 @@ func (t *TorinoMap) Repr() string {
 	return t.String()
 }
 
+func (t *TorinoMap) TypeName() string {
+	return "map"
+}
+
 func (t *TorinoMap) Get(key TorinoValue) (TorinoValue, bool) {
 	val, ok := t.Values[key.Repr()]
 	return val, ok
 }
 
 func (t *TorinoMap) Put(key TorinoValue, val TorinoValue) {
-	t.Values[key.Repr()] = val
+	repr := key.Repr()
+	if _, ok := t.Values[repr]; !ok {
+		t.Keys = append(t.Keys, key)
+	}
+	t.Values[repr] = val
+}
+
+// Return the repr of a value inside a list or map. `seen` holds the lists and maps
+// that are already being printed, which are printed as [...] and {...} the second
+// time so that a list or map that contains itself does not recurse forever.
+func reprNested(val TorinoValue, seen map[TorinoValue]bool) string {
+	switch v := val.(type) {
+	case *TorinoList:
+		return v.repr(seen)
+	case *TorinoMap:
+		return v.repr(seen)
+	default:
+		return val.Repr()
+	}
+}
+
+// Compare two Torino values for structural equality. Values of different types are
+// never equal. Lists and maps are equal if their elements are equal, and builtins
+// are only equal to themselves.
+func Equal(x TorinoValue, y TorinoValue) bool {
+	return equal(x, y, map[[2]TorinoValue]bool{})
+}
+
+// Compare two values like Equal. `seen` holds the pairs of lists and maps that are
+// already being compared, which are assumed to be equal when they are reached again,
+// so that comparing values that contain themselves does not recurse forever.
+func equal(x TorinoValue, y TorinoValue, seen map[[2]TorinoValue]bool) bool {
+	switch xv := x.(type) {
+	case *TorinoInt:
+		yv, ok := y.(*TorinoInt)
+		return ok && xv.Value == yv.Value
+	case *TorinoString:
+		yv, ok := y.(*TorinoString)
+		return ok && xv.Value == yv.Value
+	case *TorinoBool:
+		yv, ok := y.(*TorinoBool)
+		return ok && xv.Value == yv.Value
+	case *TorinoNone:
+		_, ok := y.(*TorinoNone)
+		return ok
+	case *TorinoList:
+		yv, ok := y.(*TorinoList)
+		if !ok || len(xv.Values) != len(yv.Values) {
+			return false
+		}
+
+		pair := [2]TorinoValue{x, y}
+		if seen[pair] {
+			return true
+		}
+		seen[pair] = true
+
+		for i := range xv.Values {
+			if !equal(xv.Values[i], yv.Values[i], seen) {
+				return false
+			}
+		}
+		return true
+	case *TorinoMap:
+		yv, ok := y.(*TorinoMap)
+		if !ok || len(xv.Values) != len(yv.Values) {
+			return false
+		}
+
+		pair := [2]TorinoValue{x, y}
+		if seen[pair] {
+			return true
+		}
+		seen[pair] = true
+
+		for key, xval := range xv.Values {
+			yval, ok := yv.Values[key]
+			if !ok || !equal(xval, yval, seen) {
+				return false
+			}
+		}
+		return true
+	default:
+		return x == y
+	}
 }
@@ -0,0 +1,111 @@
+package data
+
+import "unicode/utf8"
+
+// A value that can be iterated over by a for loop.
+type Iterable interface {
+	TorinoValue
+	Iter() *TorinoIterator
+}
+
+// A lazy sequence of Torino values. Iterating does not modify the underlying
+// collection, if there is one.
+type TorinoIterator struct {
+	next func() (TorinoValue, bool)
+}
+
+// Create an iterator from a function that returns the next value in the sequence,
+// or false once the sequence is exhausted.
+func NewIterator(next func() (TorinoValue, bool)) *TorinoIterator {
+	return &TorinoIterator{next}
+}
+
+func (t *TorinoIterator) Torino() {}
+
+func (t *TorinoIterator) String() string {
+	return "<iterator>"
+}
+
+func (t *TorinoIterator) Repr() string {
+	return t.String()
+}
+
+func (t *TorinoIterator) TypeName() string {
+	return "iterator"
+}
+
+// Return the next value of the iterator, or false if it is exhausted.
+func (t *TorinoIterator) Next() (TorinoValue, bool) {
+	return t.next()
+}
+
+func (t *TorinoIterator) Iter() *TorinoIterator {
+	return t
+}
+
+// Iterate over the elements of the list. Elements appended during iteration are
+// included.
+func (t *TorinoList) Iter() *TorinoIterator {
+	i := 0
+	return NewIterator(func() (TorinoValue, bool) {
+		if i >= len(t.Values) {
+			return nil, false
+		}
+		i += 1
+		return t.Values[i-1], true
+	})
+}
+
+// Iterate over the characters of the string, each of which is a UTF-8 encoded code
+// point. Bytes that are not valid UTF-8 are yielded one at a time.
+func (t *TorinoString) Iter() *TorinoIterator {
+	i := 0
+	return NewIterator(func() (TorinoValue, bool) {
+		if i >= len(t.Value) {
+			return nil, false
+		}
+		_, size := utf8.DecodeRuneInString(t.Value[i:])
+		i += size
+		return &TorinoString{t.Value[i-size : i]}, true
+	})
+}
+
+// Iterate over the keys of the map, in insertion order. Keys added during iteration
+// are not included.
+func (t *TorinoMap) Iter() *TorinoIterator {
+	i := 0
+	n := len(t.Keys)
+	return NewIterator(func() (TorinoValue, bool) {
+		if i >= n {
+			return nil, false
+		}
+		i += 1
+		return t.Keys[i-1], true
+	})
+}
+
+// Iterate over the map as a sequence of two-element [key, value] lists.
+func (t *TorinoMap) Items() *TorinoIterator {
+	keys := t.Iter()
+	return NewIterator(func() (TorinoValue, bool) {
+		key, ok := keys.Next()
+		if !ok {
+			return nil, false
+		}
+		val, _ := t.Get(key)
+		return &TorinoList{[]TorinoValue{key, val}}, true
+	})
+}
+
+// Wrap an iterator so that it yields two-element [index, value] lists.
+func Enumerate(it *TorinoIterator) *TorinoIterator {
+	i := 0
+	return NewIterator(func() (TorinoValue, bool) {
+		val, ok := it.Next()
+		if !ok {
+			return nil, false
+		}
+		i += 1
+		return &TorinoList{[]TorinoValue{&TorinoInt{i - 1}, val}}, true
+	})
+}
@@ -0,0 +1,234 @@
+package data
+
+import (
+	"fmt"
+	"github.com/iafisher/torino/errs"
+	"strings"
+)
+
+// A method of a built-in type. `self` is the value the method was called on.
+type TorinoMethod func(self TorinoValue, args ...TorinoValue) (TorinoValue, error)
+
+// Method tables for the built-in types, keyed by type name.
+var methodTables = map[string]map[string]TorinoMethod{
+	"string": {
+		"len":      stringLen,
+		"split":    stringSplit,
+		"contains": stringContains,
+		"upper":    stringUpper,
+		"lower":    stringLower,
+		"strip":    stringStrip,
+		"join":     stringJoin,
+	},
+	"list": {
+		"len":      listLen,
+		"append":   listAppend,
+		"pop":      listPop,
+		"contains": listContains,
+	},
+	"map": {
+		"len":      mapLen,
+		"keys":     mapKeys,
+		"values":   mapValues,
+		"contains": mapContains,
+	},
+}
+
+// Look up a method by name on a value.
+func LookupMethod(self TorinoValue, name string) (TorinoMethod, bool) {
+	table, ok := methodTables[self.TypeName()]
+	if !ok {
+		return nil, false
+	}
+
+	method, ok := table[name]
+	return method, ok
+}
+
+func stringLen(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("string.len", args, 0); err != nil {
+		return nil, err
+	}
+	return &TorinoInt{self.(*TorinoString).Len()}, nil
+}
+
+func stringSplit(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	str := self.(*TorinoString).Value
+
+	var parts []string
+	if len(args) == 0 {
+		parts = strings.Fields(str)
+	} else if len(args) == 1 {
+		sep, ok := args[0].(*TorinoString)
+		if !ok {
+			return nil, errs.NewRuntimeError(errs.CODE_TYPE, "string.split takes a string argument")
+		}
+
+		if sep.Value == "" {
+			return nil, errs.NewRuntimeError(errs.CODE_VALUE, "string.split separator cannot be empty")
+		}
+		parts = strings.Split(str, sep.Value)
+	} else {
+		return nil, errs.NewRuntimeError(errs.CODE_ARGUMENTS, "string.split takes zero or one arguments")
+	}
+
+	values := make([]TorinoValue, 0, len(parts))
+	for _, part := range parts {
+		values = append(values, &TorinoString{part})
+	}
+	return &TorinoList{values}, nil
+}
+
+func stringContains(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("string.contains", args, 1); err != nil {
+		return nil, err
+	}
+
+	sub, ok := args[0].(*TorinoString)
+	if !ok {
+		return nil, errs.NewRuntimeError(errs.CODE_TYPE, "string.contains takes a string argument")
+	}
+	return &TorinoBool{strings.Contains(self.(*TorinoString).Value, sub.Value)}, nil
+}
+
+func stringUpper(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("string.upper", args, 0); err != nil {
+		return nil, err
+	}
+	return &TorinoString{strings.ToUpper(self.(*TorinoString).Value)}, nil
+}
+
+func stringLower(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("string.lower", args, 0); err != nil {
+		return nil, err
+	}
+	return &TorinoString{strings.ToLower(self.(*TorinoString).Value)}, nil
+}
+
+func stringStrip(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("string.strip", args, 0); err != nil {
+		return nil, err
+	}
+	return &TorinoString{strings.TrimSpace(self.(*TorinoString).Value)}, nil
+}
+
+func stringJoin(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("string.join", args, 1); err != nil {
+		return nil, err
+	}
+
+	lst, ok := args[0].(*TorinoList)
+	if !ok {
+		return nil, errs.NewRuntimeError(errs.CODE_TYPE, "string.join takes a list argument")
+	}
+
+	parts := make([]string, 0, len(lst.Values))
+	for _, val := range lst.Values {
+		str, ok := val.(*TorinoString)
+		if !ok {
+			return nil, errs.NewRuntimeError(errs.CODE_TYPE, "string.join takes a list of strings")
+		}
+		parts = append(parts, str.Value)
+	}
+	return &TorinoString{strings.Join(parts, self.(*TorinoString).Value)}, nil
+}
+
+func listLen(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("list.len", args, 0); err != nil {
+		return nil, err
+	}
+	return &TorinoInt{len(self.(*TorinoList).Values)}, nil
+}
+
+func listAppend(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("list.append", args, 1); err != nil {
+		return nil, err
+	}
+
+	lst := self.(*TorinoList)
+	lst.Values = append(lst.Values, args[0])
+	return &TorinoNone{}, nil
+}
+
+func listPop(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("list.pop", args, 0); err != nil {
+		return nil, err
+	}
+
+	lst := self.(*TorinoList)
+	if len(lst.Values) == 0 {
+		return nil, errs.NewRuntimeError(errs.CODE_VALUE, "pop from empty list")
+	}
+
+	last := lst.Values[len(lst.Values)-1]
+	lst.Values = lst.Values[:len(lst.Values)-1]
+	return last, nil
+}
+
+func listContains(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("list.contains", args, 1); err != nil {
+		return nil, err
+	}
+
+	for _, val := range self.(*TorinoList).Values {
+		if Equal(val, args[0]) {
+			return &TorinoBool{true}, nil
+		}
+	}
+	return &TorinoBool{false}, nil
+}
+
+func mapLen(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("map.len", args, 0); err != nil {
+		return nil, err
+	}
+	return &TorinoInt{len(self.(*TorinoMap).Values)}, nil
+}
+
+func mapKeys(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("map.keys", args, 0); err != nil {
+		return nil, err
+	}
+
+	keys := make([]TorinoValue, len(self.(*TorinoMap).Keys))
+	copy(keys, self.(*TorinoMap).Keys)
+	return &TorinoList{keys}, nil
+}
+
+func mapValues(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("map.values", args, 0); err != nil {
+		return nil, err
+	}
+
+	m := self.(*TorinoMap)
+	values := make([]TorinoValue, 0, len(m.Keys))
+	for _, key := range m.Keys {
+		val, _ := m.Get(key)
+		values = append(values, val)
+	}
+	return &TorinoList{values}, nil
+}
+
+func mapContains(self TorinoValue, args ...TorinoValue) (TorinoValue, error) {
+	if err := CheckArgCount("map.contains", args, 1); err != nil {
+		return nil, err
+	}
+
+	_, ok := self.(*TorinoMap).Get(args[0])
+	return &TorinoBool{ok}, nil
+}
+
+// Return an error unless exactly `n` arguments were passed to the function `name`.
+func CheckArgCount(name string, args []TorinoValue, n int) error {
+	if len(args) == n {
+		return nil
+	}
+
+	if n == 0 {
+		return errs.NewRuntimeError(errs.CODE_ARGUMENTS, fmt.Sprintf("%s takes no arguments", name))
+	} else if n == 1 {
+		return errs.NewRuntimeError(errs.CODE_ARGUMENTS, fmt.Sprintf("%s takes one argument", name))
+	} else {
+		return errs.NewRuntimeError(errs.CODE_ARGUMENTS, fmt.Sprintf("%s takes %d arguments", name, n))
+	}
+}
@@ -0,0 +1,274 @@
+/* Error types for the different stages of the interpreter, and a renderer that
+displays them alongside the offending line of source code.
+
+Every error carries a location in the source code (which may be nil if no
+location is known), a human-readable message, and an error code that uniquely
+identifies the kind of error.
+*/
+package errs
+
+import (
+	"fmt"
+	"github.com/iafisher/torino/lexer"
+	"strings"
+)
+
+const (
+	// Syntax errors, raised by the parser
+	CODE_UNEXPECTED_TOKEN = "E100"
+	CODE_EXPECTED_TOKEN   = "E101"
+	CODE_INVALID_TARGET   = "E102"
+	CODE_INVALID_INTEGER  = "E103"
+	CODE_LOOP_VARIABLES   = "E105"
+
+	// Compile errors, raised by the compiler
+	CODE_INTERNAL       = "E200"
+	CODE_OUTSIDE_LOOP   = "E201"
+	CODE_UNDEFINED_NAME = "E202"
+	CODE_REDEFINITION   = "E203"
+
+	// Runtime errors, raised by the virtual machine
+	CODE_RUNTIME          = "E300"
+	CODE_TYPE             = "E301"
+	CODE_INDEX            = "E302"
+	CODE_NAME             = "E303"
+	CODE_DIVISION_BY_ZERO = "E304"
+	CODE_ARGUMENTS        = "E305"
+	CODE_VALUE            = "E306"
+	CODE_RECURSION        = "E307"
+
+	// Limit errors, raised by the virtual machine when a program exceeds a limit
+	// that the host placed on its execution
+	CODE_INSTRUCTION_LIMIT = "E400"
+	CODE_STACK_LIMIT       = "E401"
+	CODE_COLLECTION_LIMIT  = "E402"
+	CODE_CANCELLED         = "E403"
+)
+
+// The kinds of limit errors, keyed by code.
+var limitKinds = map[string]string{
+	CODE_INSTRUCTION_LIMIT: "InstructionLimitError",
+	CODE_STACK_LIMIT:       "StackLimitError",
+	CODE_COLLECTION_LIMIT:  "CollectionLimitError",
+	CODE_CANCELLED:         "CancelledError",
+}
+
+// The interface implemented by all Torino errors.
+type TorinoError interface {
+	error
+	// The name of the error type, e.g. "SyntaxError".
+	Kind() string
+	Code() string
+	Message() string
+	Location() *lexer.Location
+}
+
+type baseError struct {
+	loc  *lexer.Location
+	code string
+	msg  string
+}
+
+func (e *baseError) Code() string {
+	return e.code
+}
+
+func (e *baseError) Message() string {
+	return e.msg
+}
+
+func (e *baseError) Location() *lexer.Location {
+	return e.loc
+}
+
+func (e *baseError) Error() string {
+	if e.loc == nil {
+		return e.msg
+	} else {
+		return fmt.Sprintf("%s: %s", e.loc, e.msg)
+	}
+}
+
+// An error in the syntax of a program.
+type SyntaxError struct {
+	baseError
+}
+
+func NewSyntaxError(loc *lexer.Location, code string, msg string) *SyntaxError {
+	return &SyntaxError{baseError{loc, code, msg}}
+}
+
+func (e *SyntaxError) Kind() string {
+	return "SyntaxError"
+}
+
+// An error in a syntactically valid program that is detected before the program
+// is run, e.g. a break statement outside of a loop.
+type CompileError struct {
+	baseError
+}
+
+func NewCompileError(loc *lexer.Location, code string, msg string) *CompileError {
+	return &CompileError{baseError{loc, code, msg}}
+}
+
+func (e *CompileError) Kind() string {
+	return "CompileError"
+}
+
+// An error raised while a program is running.
+type RuntimeError struct {
+	baseError
+	kind string
+	// The function calls that were active when the error was raised, outermost
+	// first.
+	Traceback []Frame
+}
+
+// A frame of a traceback: the name of a function, and the location in it that was
+// being executed.
+type Frame struct {
+	Function string
+	Loc      *lexer.Location
+}
+
+// Create a runtime error with no location. The virtual machine fills in the
+// location of the instruction that raised the error, and the traceback.
+func NewRuntimeError(code string, msg string) *RuntimeError {
+	return &RuntimeError{baseError{nil, code, msg}, "RuntimeError", nil}
+}
+
+// Create a runtime error for a program that exceeded a limit on its execution or was
+// cancelled. Each limit has its own code and kind, so that hosts can tell them apart
+// from each other and from errors in the program itself.
+func NewLimitError(code string, msg string) *RuntimeError {
+	return &RuntimeError{baseError{nil, code, msg}, limitKinds[code], nil}
+}
+
+func (e *RuntimeError) Kind() string {
+	return e.kind
+}
+
+// Set the location of the error if it does not already have one.
+func (e *RuntimeError) SetLocation(loc *lexer.Location) {
+	if e.loc == nil {
+		e.loc = loc
+	}
+}
+
+// A list of errors, e.g. all the syntax errors in a program.
+type ErrorList []TorinoError
+
+func (e ErrorList) Error() string {
+	msgs := []string{}
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// The number of identical consecutive frames of a traceback that are rendered before
+// the rest are abbreviated.
+const MAX_REPEATED_FRAMES = 3
+
+// Render an error for display to the user. If the error is a TorinoError with a
+// location, the offending line of `source` is printed beneath the message with a
+// caret pointing to the error's column. Runtime errors raised inside a function are
+// preceded by their traceback. Each error in an ErrorList is rendered in
+// turn. `filename` may be empty, e.g. in the REPL.
+func Render(err error, source string, filename string) string {
+	if list, ok := err.(ErrorList); ok {
+		var sb strings.Builder
+		for _, err := range list {
+			sb.WriteString(Render(err, source, filename))
+		}
+		return sb.String()
+	}
+
+	terr, ok := err.(TorinoError)
+	if !ok {
+		return fmt.Sprintf("Error: %s\n", err)
+	}
+
+	var sb strings.Builder
+	if rerr, ok := err.(*RuntimeError); ok && len(rerr.Traceback) > 1 {
+		sb.WriteString("Traceback (most recent call last):\n")
+		// Runs of identical frames, e.g. from unbounded recursion, are abbreviated.
+		last := ""
+		count := 0
+		for _, frame := range rerr.Traceback {
+			line := renderFrame(frame, filename)
+			if line == last {
+				count += 1
+			} else {
+				writeRepeatedFrames(&sb, count)
+				last = line
+				count = 1
+			}
+
+			if count <= MAX_REPEATED_FRAMES {
+				sb.WriteString(line)
+			}
+		}
+		writeRepeatedFrames(&sb, count)
+	}
+
+	loc := terr.Location()
+	if loc != nil {
+		if filename != "" {
+			sb.WriteString(filename)
+			sb.WriteString(":")
+		}
+		sb.WriteString(fmt.Sprintf("%s: ", loc))
+	} else if filename != "" {
+		sb.WriteString(fmt.Sprintf("%s: ", filename))
+	}
+	sb.WriteString(fmt.Sprintf("%s [%s]: %s\n", terr.Kind(), terr.Code(), terr.Message()))
+
+	if loc == nil {
+		return sb.String()
+	}
+
+	lines := strings.Split(source, "\n")
+	if loc.Line < 1 || loc.Line > len(lines) {
+		return sb.String()
+	}
+
+	line := lines[loc.Line-1]
+	lineno := fmt.Sprintf("%d", loc.Line)
+	gutter := strings.Repeat(" ", len(lineno))
+	sb.WriteString(fmt.Sprintf(" %s | %s\n", lineno, line))
+	sb.WriteString(fmt.Sprintf(" %s | %s^\n", gutter, caretPadding(line, loc.Column)))
+	return sb.String()
+}
+
+// Return the whitespace that precedes column `column` of `line`. Tabs are kept
+// so that the caret lines up with the source line however tabs are displayed.
+func caretPadding(line string, column int) string {
+	var sb strings.Builder
+	for i := 0; i < column-1 && i < len(line); i++ {
+		if line[i] == '\t' {
+			sb.WriteByte('\t')
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	return sb.String()
+}
+
+func renderFrame(frame Frame, filename string) string {
+	if frame.Loc == nil {
+		return fmt.Sprintf("  in %s\n", frame.Function)
+	} else if filename != "" {
+		return fmt.Sprintf("  in %s at %s:%s\n", frame.Function, filename, frame.Loc)
+	} else {
+		return fmt.Sprintf("  in %s at %s\n", frame.Function, frame.Loc)
+	}
+}
+
+func writeRepeatedFrames(sb *strings.Builder, count int) {
+	if count > MAX_REPEATED_FRAMES {
+		sb.WriteString(fmt.Sprintf(
+			"  [previous frame repeated %d more times]\n", count-MAX_REPEATED_FRAMES))
+	}
+}
@@ -0,0 +1,100 @@
+package errs
+
+import (
+	"errors"
+	"github.com/iafisher/torino/lexer"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	err := NewSyntaxError(&lexer.Location{2, 9}, CODE_UNEXPECTED_TOKEN, "unexpected token")
+	got := Render(err, "let x = 1\nlet y = )\n", "test.tno")
+	expected := "test.tno:2:9: SyntaxError [E100]: unexpected token\n" +
+		" 2 | let y = )\n" +
+		"   |         ^\n"
+	if got != expected {
+		t.Fatalf("Wrong rendering: expected %q, got %q", expected, got)
+	}
+}
+
+func TestRenderKeepsTabs(t *testing.T) {
+	err := NewRuntimeError(CODE_DIVISION_BY_ZERO, "division by zero")
+	err.SetLocation(&lexer.Location{10, 4})
+	got := Render(err, "1\n2\n3\n4\n5\n6\n7\n8\n9\n\tx / 0", "")
+	expected := "10:4: RuntimeError [E304]: division by zero\n" +
+		" 10 | \tx / 0\n" +
+		"    | \t  ^\n"
+	if got != expected {
+		t.Fatalf("Wrong rendering: expected %q, got %q", expected, got)
+	}
+}
+
+func TestRenderWithoutLocation(t *testing.T) {
+	got := Render(NewRuntimeError(CODE_RUNTIME, "oops"), "", "test.tno")
+	expected := "test.tno: RuntimeError [E300]: oops\n"
+	if got != expected {
+		t.Fatalf("Wrong rendering: expected %q, got %q", expected, got)
+	}
+
+	got = Render(errors.New("oops"), "", "test.tno")
+	expected = "Error: oops\n"
+	if got != expected {
+		t.Fatalf("Wrong rendering: expected %q, got %q", expected, got)
+	}
+}
+
+func TestRenderErrorList(t *testing.T) {
+	err := ErrorList{
+		NewSyntaxError(&lexer.Location{1, 1}, CODE_EXPECTED_TOKEN, "first"),
+		NewSyntaxError(&lexer.Location{2, 3}, CODE_UNEXPECTED_TOKEN, "second"),
+	}
+	got := Render(err, "a\nbcd", "")
+	expected := "1:1: SyntaxError [E101]: first\n" +
+		" 1 | a\n" +
+		"   | ^\n" +
+		"2:3: SyntaxError [E100]: second\n" +
+		" 2 | bcd\n" +
+		"   |   ^\n"
+	if got != expected {
+		t.Fatalf("Wrong rendering: expected %q, got %q", expected, got)
+	}
+}
+
+func TestRenderTraceback(t *testing.T) {
+	err := NewRuntimeError(CODE_INDEX, "index out of bounds")
+	err.SetLocation(&lexer.Location{2, 9})
+	err.Traceback = []Frame{{"<program>", &lexer.Location{4, 1}}, {"f", &lexer.Location{2, 9}}}
+	got := Render(err, "fn f(x) {\n\treturn x[1]\n}\nf([])", "test.tno")
+	expected := "Traceback (most recent call last):\n" +
+		"  in <program> at test.tno:4:1\n" +
+		"  in f at test.tno:2:9\n" +
+		"test.tno:2:9: RuntimeError [E302]: index out of bounds\n" +
+		" 2 | \treturn x[1]\n" +
+		"   | \t       ^\n"
+	if got != expected {
+		t.Fatalf("Wrong rendering: expected %q, got %q", expected, got)
+	}
+}
+
+func TestRenderRepeatedFrames(t *testing.T) {
+	err := NewRuntimeError(CODE_RECURSION, "maximum recursion depth exceeded")
+	err.SetLocation(&lexer.Location{2, 9})
+	err.Traceback = []Frame{{"<program>", &lexer.Location{4, 1}}}
+	for i := 0; i < 10; i++ {
+		err.Traceback = append(err.Traceback, Frame{"f", &lexer.Location{2, 9}})
+	}
+
+	got := Render(err, "fn f() {\n\treturn f()\n}\nf()", "")
+	expected := "Traceback (most recent call last):\n" +
+		"  in <program> at 4:1\n" +
+		"  in f at 2:9\n" +
+		"  in f at 2:9\n" +
+		"  in f at 2:9\n" +
+		"  [previous frame repeated 7 more times]\n" +
+		"2:9: RuntimeError [E307]: maximum recursion depth exceeded\n" +
+		" 2 | \treturn f()\n" +
+		"   | \t       ^\n"
+	if got != expected {
+		t.Fatalf("Wrong rendering: expected %q, got %q", expected, got)
+	}
+}
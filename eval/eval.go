@@ -6,28 +6,59 @@ Version: February 2019
 package eval
 
 import (
-	"errors"
+	"fmt"
 	"github.com/iafisher/torino/compiler"
 	"github.com/iafisher/torino/data"
+	"github.com/iafisher/torino/errs"
 	"github.com/iafisher/torino/lexer"
 	"github.com/iafisher/torino/parser"
 	"github.com/iafisher/torino/vm"
 )
 
+// Evaluate a program. If the program has syntax errors, all of them are returned
+// as an errs.ErrorList.
 func Eval(text string, env *vm.Environment) (data.TorinoValue, error) {
-	vm := vm.New()
+	code, err := CompileIn(text, env)
+	if err != nil {
+		return nil, err
+	}
+
+	return vm.New().Execute(code, env)
+}
 
+// Evaluate a program like Eval, but instead of returning an error, write it to the
+// environment's stderr with errs.Render and return false. `path` is the name of the
+// file that the program was read from, or empty if there is none.
+func Run(text string, path string, env *vm.Environment) (data.TorinoValue, bool) {
+	val, err := Eval(text, env)
+	if err != nil {
+		fmt.Fprint(env.Stderr(), errs.Render(err, text, path))
+		return nil, false
+	}
+	return val, true
+}
+
+// Compile a program to bytecode without executing it. The program may refer to the
+// builtins but to no other globals that it does not define itself. Errors are
+// returned as for Eval.
+func Compile(text string) (*compiler.TorinoCode, error) {
+	return CompileIn(text, vm.NewEnv(nil))
+}
+
+// Compile a program that will be executed in `env`, so that it may refer to the
+// globals that are already defined there.
+func CompileIn(text string, env *vm.Environment) (*compiler.TorinoCode, error) {
 	p := parser.New(lexer.New(text))
 	ast, ok := p.Parse()
 	if !ok {
-		return nil, errors.New(p.Errors()[0])
+		errors := errs.ErrorList{}
+		for _, err := range p.Errors() {
+			errors = append(errors, err)
+		}
+		return nil, errors
 	}
 
 	cmp := compiler.New()
-	program, err := cmp.Compile(ast)
-	if err != nil {
-		return nil, err
-	}
-
-	return vm.Execute(program, env)
+	cmp.DeclareGlobals(env.Names())
+	return cmp.Compile(ast)
 }
@@ -1,9 +1,18 @@
 package eval
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/iafisher/torino/compiler"
 	"github.com/iafisher/torino/data"
+	"github.com/iafisher/torino/errs"
+	"github.com/iafisher/torino/lexer"
+	"github.com/iafisher/torino/parser"
 	"github.com/iafisher/torino/vm"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEvalLetAndAssign(t *testing.T) {
@@ -87,6 +96,22 @@ x
 	checkInteger(t, val, 42)
 }
 
+func TestEvalIfTakesFirstOfSeveralClauses(t *testing.T) {
+	input := `
+let x = 1
+if x == 1 {
+	x = 2
+} elif x == 2 {
+	x = 3
+} else {
+	x = 4
+}
+x
+`
+	val := evalHelper(t, input)
+	checkInteger(t, val, 2)
+}
+
 func TestEvalFunctionDeclaration(t *testing.T) {
 	input := `
 fn return42() {
@@ -112,100 +137,1855 @@ return42()
 	checkInteger(t, val, 42)
 }
 
-func TestEvalWhileLoop(t *testing.T) {
+func TestEvalFunctionDoesNotSeeCallerLocals(t *testing.T) {
 	input := `
-let x = 0
-while x < 42 {
-	x = x + 1
+fn f() {
+	return x
 }
-x
+
+fn g() {
+	let x = 1
+	return f()
+}
+
+let x = 2
+g()
 `
 	val := evalHelper(t, input)
-	checkInteger(t, val, 42)
+	checkInteger(t, val, 2)
 }
 
-func TestEvalList(t *testing.T) {
-	val := evalHelper(t, "[1, 2, 3]")
+func TestEvalFunctionCallsLaterFunction(t *testing.T) {
+	input := `
+fn isEven(n) {
+	if n == 0 {
+		return true
+	}
+	return isOdd(n - 1)
+}
 
-	listVal := checkList(t, val, 3)
+fn isOdd(n) {
+	if n == 0 {
+		return false
+	}
+	return isEven(n - 1)
+}
+
+isEven(10)
+`
+	val := evalHelper(t, input)
+	checkBool(t, val, true)
+}
+
+func TestEvalShadowing(t *testing.T) {
+	input := `
+let x = 1
+let inner = 0
+if true {
+	let x = x + 1
+	if true {
+		let x = x * 10
+		inner = x
+	}
+	x += 1
+	inner += x
+}
+[x, inner]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 2)
 	checkInteger(t, listVal.Values[0], 1)
-	checkInteger(t, listVal.Values[1], 2)
-	checkInteger(t, listVal.Values[2], 3)
+	checkInteger(t, listVal.Values[1], 23)
 }
 
-func TestEvalIndex(t *testing.T) {
-	val := evalHelper(t, "[\"a\", \"b\", \"c\"][2]")
+func TestEvalLetInLoopBody(t *testing.T) {
+	input := `
+fn sum(lst) {
+	let total = 0
+	let i = 0
+	while i < lst.len() {
+		let x = lst[i]
+		total += x
+		i += 1
+	}
+	return total
+}
 
-	checkString(t, val, "c")
+let total = 0
+for x in [1, 2, 3] {
+	let doubled = x * 2
+	total += doubled
+}
+for x in [10, 20] {
+	total += x
+}
+[sum([4, 5, 6]), total]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 2)
+	checkInteger(t, listVal.Values[0], 15)
+	checkInteger(t, listVal.Values[1], 42)
 }
 
-func TestEvalMap(t *testing.T) {
-	val := evalHelper(t, "{\"one\": 1, \"two\": 1+1}")
+func TestEvalScopeErrors(t *testing.T) {
+	evalErrorHelper(t, "let x = 1\nprintln(y)", "2:9: undefined symbol y")
+	evalErrorHelper(t, "y = 1", "1:1: undefined symbol y")
+	evalErrorHelper(t, "if true {\n\tlet x = 1\n}\nx", "4:1: undefined symbol x")
+	evalErrorHelper(t, "for x in [1] {\n}\nx", "3:1: undefined symbol x")
+	evalErrorHelper(t, "fn f(x) {\n\tlet x = 1\n}", "2:6: cannot redefine symbol x")
+	evalErrorHelper(t, "let x = 1\nlet x = 2", "2:5: cannot redefine symbol x")
+	evalErrorHelper(t, "fn f() {\n\treturn y\n}\nf()", "2:9: undefined symbol y")
 
-	mapVal := checkMap(t, val, 2)
+	// Names are checked before the program starts running.
+	evalErrorHelper(t, "println(1)\nprintln(y)", "2:9: undefined symbol y")
 
-	first, ok := mapVal.Get(&data.TorinoString{"one"})
-	if !ok {
-		t.Fatalf("Expected \"one\" to be in the map")
+	// Globals declared later in the program can be referred to, but not used
+	// before they are defined.
+	evalErrorHelper(t, "println(x)\nlet x = 1", "1:9: undefined symbol x")
+}
+
+func TestEvalClosure(t *testing.T) {
+	input := `
+fn makeCounter() {
+	let count = 0
+	fn increment() {
+		count += 1
+		return count
 	}
-	checkInteger(t, first, 1)
+	return increment
+}
 
-	second, ok := mapVal.Get(&data.TorinoString{"two"})
-	if !ok {
-		t.Fatalf("Expected \"two\" to be in the map")
+let c1 = makeCounter()
+let c2 = makeCounter()
+c1()
+c1()
+c2()
+[c1(), c2()]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 2)
+	checkInteger(t, listVal.Values[0], 3)
+	checkInteger(t, listVal.Values[1], 2)
+}
+
+func TestEvalFunctionExpression(t *testing.T) {
+	input := `
+fn adder(n) {
+	return fn(x) { return x + n }
+}
+
+let add2 = adder(2)
+[add2(1), fn(x) { return x * 3 }(2), map(fn(x) { return x * 2 }, [1, 2, 3])]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 3)
+	checkInteger(t, listVal.Values[0], 3)
+	checkInteger(t, listVal.Values[1], 6)
+
+	mapped := checkList(t, listVal.Values[2], 3)
+	checkInteger(t, mapped.Values[0], 2)
+	checkInteger(t, mapped.Values[1], 4)
+	checkInteger(t, mapped.Values[2], 6)
+}
+
+func TestEvalNestedClosures(t *testing.T) {
+	input := `
+fn outer() {
+	let x = 1
+	fn middle() {
+		fn inner() {
+			x *= 10
+			return x
+		}
+		return inner
 	}
-	checkInteger(t, second, 2)
+	let f = middle()
+	f()
+	let y = f()
+	return [y, x]
 }
 
-func TestEvalIndexMap(t *testing.T) {
+outer()
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 2)
+	checkInteger(t, listVal.Values[0], 100)
+	checkInteger(t, listVal.Values[1], 100)
+}
+
+func TestEvalRecursiveNestedFunction(t *testing.T) {
 	input := `
-let m = {"one": 1}
-let x = m["one"]
-x
+fn sumTo(n) {
+	fn loop(i, total) {
+		if i > n {
+			return total
+		}
+		return loop(i + 1, total + i)
+	}
+	return loop(1, 0)
+}
+
+sumTo(10)
 `
 	val := evalHelper(t, input)
+	checkInteger(t, val, 55)
+}
 
-	checkInteger(t, val, 1)
+func TestEvalClosuresInLoop(t *testing.T) {
+	input := `
+let fs = []
+for i in range(3) {
+	fs.append(fn() { return i })
 }
+map(fn(f) { return f() }, fs)
+`
+	val := evalHelper(t, input)
 
-func TestEvalIndexStr(t *testing.T) {
-	val := evalHelper(t, "\"abc\"[0]")
+	// Each iteration has its own loop variable.
+	listVal := checkList(t, val, 3)
+	checkInteger(t, listVal.Values[0], 0)
+	checkInteger(t, listVal.Values[1], 1)
+	checkInteger(t, listVal.Values[2], 2)
+}
 
-	checkString(t, val, "a")
+func TestEvalMapErrors(t *testing.T) {
+	evalErrorHelper(t, "map(1, [1])", "1:1: cannot apply non-function")
+	evalErrorHelper(t, "map(fn(x) { return x }, 1)", "1:1: int is not iterable")
+	evalErrorHelper(t, "map(fn(x) {\n\treturn x // 0\n}, [1])", "2:11: division by zero")
 }
 
-func TestEvalForLoop(t *testing.T) {
+func TestEvalReturnFromLoop(t *testing.T) {
 	input := `
-let x = 0
-for i in range(6) {
-	x = x + 7
+fn first(lst) {
+	for x in lst {
+		while true {
+			return x
+		}
+	}
 }
-x
+
+let total = 0
+for i in range(100) {
+	total += first([i, 0]) + 1
+}
+[total, first([42])]
 `
 	val := evalHelper(t, input)
 
-	checkInteger(t, val, 42)
+	listVal := checkList(t, val, 2)
+	checkInteger(t, listVal.Values[0], 5050)
+	checkInteger(t, listVal.Values[1], 42)
 }
 
-// Helper functions
+func TestEvalDeepRecursion(t *testing.T) {
+	input := `
+fn depth(n) {
+	if n == 0 {
+		return 0
+	}
+	return depth(n - 1) + 1
+}
 
-func evalHelper(t *testing.T, text string) data.TorinoValue {
+depth(999)
+`
+	val := evalHelper(t, input)
+	checkInteger(t, val, 999)
+}
+
+func TestEvalRecursionLimit(t *testing.T) {
+	input := `
+fn forever(n) {
+	return forever(n + 1)
+}
+
+forever(0)
+`
+	evalErrorHelper(t, input, "3:9: maximum recursion depth exceeded")
+
+	code := compileHelper(t, "fn f(n) {\n\treturn f(n + 1)\n}\nf(0)")
+	machine := vm.New()
+	machine.SetRecursionLimit(10)
+	_, err := machine.Execute(code, vm.NewEnv(nil))
+	rerr, ok := err.(*errs.RuntimeError)
+	if !ok || rerr.Code() != errs.CODE_RECURSION {
+		t.Fatalf("Expected recursion error, got %v", err)
+	}
+
+	// The program's frame, plus ten frames of f.
+	if len(rerr.Traceback) != 11 {
+		t.Fatalf("Wrong traceback length: expected 11, got %d", len(rerr.Traceback))
+	}
+
+	// The virtual machine can be used again after the error.
+	val, err := machine.Execute(compileHelper(t, "1 + 1"), vm.NewEnv(nil))
+	if err != nil {
+		t.Fatalf("Eval error: %s", err)
+	}
+	checkInteger(t, val, 2)
+}
+
+func TestEvalRecursionLimitIsTheSameFromGo(t *testing.T) {
+	machine := vm.New()
+	machine.SetRecursionLimit(10)
+	depth := "fn depth(n) {\n\tif n == 0 {\n\t\treturn 0\n\t}\n\treturn depth(n - 1) + 1\n}\n"
+
+	// depth(9) makes ten nested calls, which is exactly the limit.
 	env := vm.NewEnv(nil)
-	val, err := Eval(text, env)
+	val, err := machine.Execute(compileHelper(t, depth+"depth(9)"), env)
 	if err != nil {
 		t.Fatalf("Eval error: %s", err)
 	}
-	return val
+	checkInteger(t, val, 9)
+
+	f, _ := env.Get("depth")
+	val, err = machine.Call(f, []data.TorinoValue{&data.TorinoInt{9}}, env)
+	if err != nil {
+		t.Fatalf("Call error: %s", err)
+	}
+	checkInteger(t, val, 9)
+
+	_, err = machine.Execute(compileHelper(t, depth+"depth(10)"), vm.NewEnv(nil))
+	if rerr, ok := err.(*errs.RuntimeError); !ok || rerr.Code() != errs.CODE_RECURSION {
+		t.Fatalf("Expected recursion error, got %v", err)
+	}
+
+	_, err = machine.Call(f, []data.TorinoValue{&data.TorinoInt{10}}, env)
+	if rerr, ok := err.(*errs.RuntimeError); !ok || rerr.Code() != errs.CODE_RECURSION {
+		t.Fatalf("Expected recursion error, got %v", err)
+	}
 }
 
-func checkInteger(t *testing.T, val data.TorinoValue, expected int) {
-	intVal, ok := val.(*data.TorinoInt)
-	if !ok {
-		t.Fatalf("Wrong Torino type: expected *TorinoInt, got %T", val)
+func TestEvalPrint(t *testing.T) {
+	var out bytes.Buffer
+	env := vm.NewEnv(nil)
+	env.SetStdout(&out)
+	_, err := Eval("print(1)\nprintln(\" two\")\nmap(println, [[3], {4: none}])", env)
+	if err != nil {
+		t.Fatalf("Eval error: %s", err)
 	}
 
-	if intVal.Value != expected {
-		t.Fatalf("Wrong integer value: expected %d, got %d", expected, intVal.Value)
+	if out.String() != "1 two\n[3]\n{4: none}\n" {
+		t.Fatalf("Wrong output: %q", out.String())
+	}
+}
+
+func TestEvalErrorOutput(t *testing.T) {
+	var out, errOut bytes.Buffer
+	env := vm.NewEnv(nil)
+	env.SetStdout(&out)
+	env.SetStderr(&errOut)
+
+	text := "fn f(x) {\n\treturn x + \"a\"\n}\n\nprintln(1)\nf(1)"
+	_, ok := Run(text, "test.tno", env)
+	if ok {
+		t.Fatal("Expected error")
+	}
+
+	if out.String() != "1\n" {
+		t.Fatalf("Wrong output: %q", out.String())
+	}
+
+	expected := "Traceback (most recent call last):\n"
+	if !strings.HasPrefix(errOut.String(), expected) ||
+		!strings.Contains(errOut.String(), "test.tno:2:11: RuntimeError [E301]: unsupported operand types for +") {
+		t.Fatalf("Wrong error output: %q", errOut.String())
+	}
+
+	// Programs that succeed write nothing to stderr.
+	errOut.Reset()
+	val, ok := Run("len(\"ab\") + 1", "test.tno", env)
+	if !ok || errOut.String() != "" {
+		t.Fatalf("Unexpected error output: %q", errOut.String())
+	}
+	checkInteger(t, val, 3)
+}
+
+func TestEvalInput(t *testing.T) {
+	input := `
+let lines = []
+while true {
+	let line = input("> ")
+	if line == none {
+		break
+	}
+	lines.append(line)
+}
+lines
+`
+	var out bytes.Buffer
+	env := vm.NewEnv(nil)
+	env.SetStdout(&out)
+	env.SetStdin(strings.NewReader("first\r\n\nlast"))
+	val, err := Eval(input, env)
+	if err != nil {
+		t.Fatalf("Eval error: %s", err)
+	}
+
+	listVal := checkList(t, val, 3)
+	checkString(t, listVal.Values[0], "first")
+	checkString(t, listVal.Values[1], "")
+	checkString(t, listVal.Values[2], "last")
+
+	if out.String() != "> > > > " {
+		t.Fatalf("Wrong output: %q", out.String())
+	}
+
+	evalErrorHelper(t, "input(\"a\", \"b\")", "1:1: input takes at most one argument")
+}
+
+func TestEvalLen(t *testing.T) {
+	val := evalHelper(t, "[len(\"abc\"), len([1, 2]), len({}), len(\"\")]")
+
+	listVal := checkList(t, val, 4)
+	checkInteger(t, listVal.Values[0], 3)
+	checkInteger(t, listVal.Values[1], 2)
+	checkInteger(t, listVal.Values[2], 0)
+	checkInteger(t, listVal.Values[3], 0)
+
+	evalErrorHelper(t, "len(1)", "1:1: int has no length")
+	evalErrorHelper(t, "len()", "1:1: len takes one argument")
+	evalErrorHelper(t, "len([], [])", "1:1: len takes one argument")
+}
+
+func TestEvalStr(t *testing.T) {
+	val := evalHelper(t, "[str(1), str(\"a\"), str([\"a\", none]), str(true)]")
+
+	listVal := checkList(t, val, 4)
+	checkString(t, listVal.Values[0], "1")
+	checkString(t, listVal.Values[1], "a")
+	checkString(t, listVal.Values[2], "[\"a\", none]")
+	checkString(t, listVal.Values[3], "true")
+
+	evalErrorHelper(t, "str()", "1:1: str takes one argument")
+}
+
+func TestEvalRepr(t *testing.T) {
+	val := evalHelper(t, "[repr(1), repr(\"a\\n\"), repr({\"a\": 1})]")
+
+	listVal := checkList(t, val, 3)
+	checkString(t, listVal.Values[0], "1")
+	checkString(t, listVal.Values[1], "\"a\\n\"")
+	checkString(t, listVal.Values[2], "{\"a\": 1}")
+
+	evalErrorHelper(t, "repr(1, 2)", "1:1: repr takes one argument")
+}
+
+func TestEvalInt(t *testing.T) {
+	val := evalHelper(t, "[int(42), int(\"-17\"), int(\" 8\\n\"), int(true), int(false)]")
+
+	listVal := checkList(t, val, 5)
+	checkInteger(t, listVal.Values[0], 42)
+	checkInteger(t, listVal.Values[1], -17)
+	checkInteger(t, listVal.Values[2], 8)
+	checkInteger(t, listVal.Values[3], 1)
+	checkInteger(t, listVal.Values[4], 0)
+
+	evalErrorHelper(t, "int(\"12a\")", "1:1: invalid integer \"12a\"")
+	evalErrorHelper(t, "int(\"\")", "1:1: invalid integer \"\"")
+	evalErrorHelper(t, "int([])", "1:1: cannot convert list to int")
+	evalErrorHelper(t, "int()", "1:1: int takes one argument")
+}
+
+func TestEvalBool(t *testing.T) {
+	input := "[bool(true), bool(1), bool(0), bool(\"a\"), bool(\"\"), bool([0]), bool({}), bool(none)]"
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 8)
+	for i, expected := range []bool{true, true, false, true, false, true, false, false} {
+		checkBool(t, listVal.Values[i], expected)
+	}
+
+	evalErrorHelper(t, "bool(print)", "1:1: cannot convert builtin to bool")
+	evalErrorHelper(t, "bool()", "1:1: bool takes one argument")
+}
+
+func TestEvalType(t *testing.T) {
+	val := evalHelper(t, "[type(1), type(\"a\"), type([]), type({}), type(none), type(fn() {}), type(len)]")
+
+	listVal := checkList(t, val, 7)
+	for i, expected := range []string{"int", "string", "list", "map", "none", "function", "builtin"} {
+		checkString(t, listVal.Values[i], expected)
+	}
+
+	evalErrorHelper(t, "type()", "1:1: type takes one argument")
+}
+
+func TestEvalAbs(t *testing.T) {
+	val := evalHelper(t, "[abs(-5), abs(5), abs(0)]")
+
+	listVal := checkList(t, val, 3)
+	checkInteger(t, listVal.Values[0], 5)
+	checkInteger(t, listVal.Values[1], 5)
+	checkInteger(t, listVal.Values[2], 0)
+
+	evalErrorHelper(t, "abs(\"a\")", "1:1: abs takes an integer argument")
+	evalErrorHelper(t, "abs(1, 2)", "1:1: abs takes one argument")
+}
+
+func TestEvalMinAndMax(t *testing.T) {
+	input := "[min(3, 1, 2), max(3, 1, 2), min([4, -1]), max(range(5)), min(\"b\", \"a\"), max(\"abc\")]"
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 6)
+	checkInteger(t, listVal.Values[0], 1)
+	checkInteger(t, listVal.Values[1], 3)
+	checkInteger(t, listVal.Values[2], -1)
+	checkInteger(t, listVal.Values[3], 4)
+	checkString(t, listVal.Values[4], "a")
+	checkString(t, listVal.Values[5], "c")
+
+	evalErrorHelper(t, "min()", "1:1: min takes at least one argument")
+	evalErrorHelper(t, "max([])", "1:1: max of an empty sequence")
+	evalErrorHelper(t, "min(1)", "1:1: int is not iterable")
+	evalErrorHelper(t, "max(1, \"a\")", "1:1: unsupported operand types for >: string and int")
+}
+
+func TestEvalSum(t *testing.T) {
+	val := evalHelper(t, "[sum([1, 2, 3]), sum([]), sum(range(101))]")
+
+	listVal := checkList(t, val, 3)
+	checkInteger(t, listVal.Values[0], 6)
+	checkInteger(t, listVal.Values[1], 0)
+	checkInteger(t, listVal.Values[2], 5050)
+
+	evalErrorHelper(t, "sum([1, \"a\"])", "1:1: cannot sum string")
+	evalErrorHelper(t, "sum(1)", "1:1: int is not iterable")
+	evalErrorHelper(t, "sum(1, 2)", "1:1: sum takes one argument")
+}
+
+func TestEvalShadowBuiltin(t *testing.T) {
+	val := evalHelper(t, "let len = 5\nfn str(x) {\n\treturn x\n}\n[len, str(1)]")
+
+	listVal := checkList(t, val, 2)
+	checkInteger(t, listVal.Values[0], 5)
+	checkInteger(t, listVal.Values[1], 1)
+
+	evalErrorHelper(t, "let len = 5\nlet len = 6", "2:5: cannot redefine symbol len")
+}
+
+func TestEvalInstructionLimit(t *testing.T) {
+	err := limitHelper(t, vm.Limits{1000, 0, 0}, "let i = 0\nwhile true {\n\ti += 1\n}")
+	checkLimitError(t, err, errs.CODE_INSTRUCTION_LIMIT, "InstructionLimitError", "maximum instruction count exceeded")
+
+	// The limit applies to each program separately.
+	machine := vm.New()
+	machine.SetLimits(vm.Limits{1000, 0, 0})
+	for i := 0; i < 3; i++ {
+		_, err := machine.Execute(compileHelper(t, "for i in range(100) {}"), vm.NewEnv(nil))
+		if err != nil {
+			t.Fatalf("Eval error: %s", err)
+		}
+	}
+}
+
+func TestEvalStackLimit(t *testing.T) {
+	input := `
+fn f(n) {
+	return f(n + 1)
+}
+
+f(0)
+`
+	err := limitHelper(t, vm.Limits{0, 100, 0}, input)
+	checkLimitError(t, err, errs.CODE_STACK_LIMIT, "StackLimitError", "maximum stack depth exceeded")
+}
+
+func TestEvalCollectionLimit(t *testing.T) {
+	limits := vm.Limits{0, 0, 10}
+	inputs := []string{
+		"[1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11]",
+		"let l = [1, 2, 3, 4, 5, 6, 7, 8, 9, 10]\nl + [11]",
+		"let l = []\nwhile true {\n\tl.append(1)\n}",
+		"let m = {}\nfor i in range(100) {\n\tm[i] = i\n}",
+		"\"abc\" * 4",
+		"\"abc\" * 1000000000000",
+		"\"é\" * 11",
+		"map(fn(x) { return x }, range(100))",
+	}
+	for _, input := range inputs {
+		err := limitHelper(t, limits, input)
+		checkLimitError(t, err, errs.CODE_COLLECTION_LIMIT, "CollectionLimitError", "maximum collection size exceeded")
+	}
+
+	// Collections at the limit are allowed.
+	machine := vm.New()
+	machine.SetLimits(limits)
+	val, err := machine.Execute(compileHelper(t, "\"ab\" * 5 + \"\""), vm.NewEnv(nil))
+	if err != nil {
+		t.Fatalf("Eval error: %s", err)
+	}
+	checkString(t, val, "ababababab")
+
+	// Strings are measured in characters rather than bytes.
+	val, err = machine.Execute(compileHelper(t, "\"é\" * 10"), vm.NewEnv(nil))
+	if err != nil {
+		t.Fatalf("Eval error: %s", err)
+	}
+	checkString(t, val, "éééééééééé")
+}
+
+func TestEvalCancelled(t *testing.T) {
+	code := compileHelper(t, "while true {}")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := vm.New().ExecuteContext(ctx, code, vm.NewEnv(nil))
+	checkLimitError(t, err, errs.CODE_CANCELLED, "CancelledError", "execution cancelled: context deadline exceeded")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = vm.New().ExecuteContext(ctx, code, vm.NewEnv(nil))
+	checkLimitError(t, err, errs.CODE_CANCELLED, "CancelledError", "execution cancelled: context canceled")
+}
+
+func TestEvalLimitsInsideInstructions(t *testing.T) {
+	// Each of these runs for a very long time within a single instruction.
+	inputs := []string{
+		"-1 in range(100000000000)",
+		"map(range, range(100000000000))",
+		"sum(range(100000000000))",
+		"min(range(100000000000))",
+		"max(range(100000000000))",
+	}
+	for _, input := range inputs {
+		err := limitHelper(t, vm.Limits{100000, 0, 0}, input)
+		checkLimitError(t, err, errs.CODE_INSTRUCTION_LIMIT, "InstructionLimitError", "maximum instruction count exceeded")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err = vm.New().ExecuteContext(ctx, compileHelper(t, input), vm.NewEnv(nil))
+		cancel()
+		checkLimitError(t, err, errs.CODE_CANCELLED, "CancelledError", "execution cancelled: context deadline exceeded")
+	}
+}
+
+func limitHelper(t *testing.T, limits vm.Limits, input string) error {
+	machine := vm.New()
+	machine.SetLimits(limits)
+	_, err := machine.Execute(compileHelper(t, input), vm.NewEnv(nil))
+	return err
+}
+
+func checkLimitError(t *testing.T, err error, code string, kind string, msg string) {
+	rerr, ok := err.(*errs.RuntimeError)
+	if !ok {
+		t.Fatalf("Expected %s, got %v", kind, err)
+	}
+
+	if rerr.Code() != code || rerr.Kind() != kind || rerr.Message() != msg {
+		t.Fatalf("Wrong error: expected %s %s (%s), got %s %s (%s)",
+			code, kind, msg, rerr.Code(), rerr.Kind(), rerr.Message())
+	}
+}
+
+func TestEvalWhileLoop(t *testing.T) {
+	input := `
+let x = 0
+while x < 42 {
+	x = x + 1
+}
+x
+`
+	val := evalHelper(t, input)
+	checkInteger(t, val, 42)
+}
+
+func TestEvalList(t *testing.T) {
+	val := evalHelper(t, "[1, 2, 3]")
+
+	listVal := checkList(t, val, 3)
+	checkInteger(t, listVal.Values[0], 1)
+	checkInteger(t, listVal.Values[1], 2)
+	checkInteger(t, listVal.Values[2], 3)
+}
+
+func TestEvalIndex(t *testing.T) {
+	val := evalHelper(t, "[\"a\", \"b\", \"c\"][2]")
+
+	checkString(t, val, "c")
+}
+
+func TestEvalMap(t *testing.T) {
+	val := evalHelper(t, "{\"one\": 1, \"two\": 1+1}")
+
+	mapVal := checkMap(t, val, 2)
+
+	first, ok := mapVal.Get(&data.TorinoString{"one"})
+	if !ok {
+		t.Fatalf("Expected \"one\" to be in the map")
+	}
+	checkInteger(t, first, 1)
+
+	second, ok := mapVal.Get(&data.TorinoString{"two"})
+	if !ok {
+		t.Fatalf("Expected \"two\" to be in the map")
+	}
+	checkInteger(t, second, 2)
+}
+
+func TestEvalIndexMap(t *testing.T) {
+	input := `
+let m = {"one": 1}
+let x = m["one"]
+x
+`
+	val := evalHelper(t, input)
+
+	checkInteger(t, val, 1)
+}
+
+func TestEvalIndexStr(t *testing.T) {
+	val := evalHelper(t, "\"abc\"[0]")
+
+	checkString(t, val, "a")
+}
+
+func TestEvalForLoop(t *testing.T) {
+	input := `
+let x = 0
+for i in range(6) {
+	x = x + 7
+}
+x
+`
+	val := evalHelper(t, input)
+
+	checkInteger(t, val, 42)
+}
+
+func TestEvalBreakInWhileLoop(t *testing.T) {
+	input := `
+let x = 0
+while true {
+	if x == 42 {
+		break
+	}
+	x = x + 1
+}
+x
+`
+	val := evalHelper(t, input)
+
+	checkInteger(t, val, 42)
+}
+
+func TestEvalContinueInWhileLoop(t *testing.T) {
+	input := `
+let i = 0
+let x = 0
+while i < 10 {
+	i = i + 1
+	if i > 6 {
+		continue
+	}
+	x = x + 7
+}
+x
+`
+	val := evalHelper(t, input)
+
+	checkInteger(t, val, 42)
+}
+
+func TestEvalBreakAndContinueInForLoop(t *testing.T) {
+	input := `
+let x = 0
+for i in [14, 1, 28, 0, 28, 1, 14] {
+	if i == 1 {
+		continue
+	} elif i == 0 {
+		break
+	}
+	x = x + i
+}
+x
+`
+	val := evalHelper(t, input)
+
+	checkInteger(t, val, 42)
+}
+
+func TestEvalBreakInNestedLoops(t *testing.T) {
+	input := `
+let x = 0
+for i in range(6) {
+	while true {
+		x = x + 7
+		break
+	}
+	continue
+	x = 666
+}
+x
+`
+	val := evalHelper(t, input)
+
+	checkInteger(t, val, 42)
+}
+
+func TestEvalBreakOutsideLoop(t *testing.T) {
+	evalErrorHelper(t, "break", "1:1: break outside of loop")
+	evalErrorHelper(t, "if true {\n\tcontinue\n}", "2:2: continue outside of loop")
+}
+
+func TestEvalIndexAssignment(t *testing.T) {
+	input := `
+let lst = [1, 2, 3]
+let m = {"one": 1}
+lst[2] = 42
+m["one"] = lst[2]
+m["two"] = 2
+[lst, m]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 2)
+	lst := checkList(t, listVal.Values[0], 3)
+	checkInteger(t, lst.Values[2], 42)
+
+	mapVal := checkMap(t, listVal.Values[1], 2)
+	one, ok := mapVal.Get(&data.TorinoString{"one"})
+	if !ok {
+		t.Fatalf("Expected \"one\" to be in the map")
+	}
+	checkInteger(t, one, 42)
+
+	two, ok := mapVal.Get(&data.TorinoString{"two"})
+	if !ok {
+		t.Fatalf("Expected \"two\" to be in the map")
+	}
+	checkInteger(t, two, 2)
+}
+
+func TestEvalIndexAssignmentErrors(t *testing.T) {
+	evalErrorHelper(t, "let lst = [1]\nlst[1] = 2", "2:1: index out of bounds")
+	evalErrorHelper(t, "let lst = [1]\nlst[-1] = 2", "2:1: index out of bounds")
+	evalErrorHelper(t, "let lst = [1]\nlst[\"a\"] = 2", "2:1: index must be an integer")
+	evalErrorHelper(t, "let s = \"abc\"\ns[0] = \"x\"", "2:1: strings are immutable")
+	evalErrorHelper(t, "let x = 1\nx[0] = 2", "2:1: only lists and maps support index assignment")
+}
+
+func TestEvalCompoundAssignment(t *testing.T) {
+	input := `
+let x = 10
+x += 11
+x *= 6
+x -= 5
+x /= 2
+x //= 2
+x
+`
+	val := evalHelper(t, input)
+
+	checkInteger(t, val, 30)
+}
+
+func TestEvalFloorDivisionAssignmentRoundsDown(t *testing.T) {
+	input := `
+let x = -7
+x //= 2
+x
+`
+	val := evalHelper(t, input)
+
+	checkInteger(t, val, -4)
+}
+
+func TestEvalCompoundAssignmentToIndex(t *testing.T) {
+	input := `
+let lst = [1, 2, 3]
+let m = {"a": 40}
+lst[1] += 40
+m["a"] += lst[0] + 1
+[lst[1], m["a"]]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 2)
+	checkInteger(t, listVal.Values[0], 42)
+	checkInteger(t, listVal.Values[1], 42)
+}
+
+func TestEvalFloorDivisionAndModulo(t *testing.T) {
+	val := evalHelper(t, "[7 // 2, -7 // 2, 7 // -2, 7 % 3, -7 % 3, 7 % -3]")
+
+	listVal := checkList(t, val, 6)
+	checkInteger(t, listVal.Values[0], 3)
+	checkInteger(t, listVal.Values[1], -4)
+	checkInteger(t, listVal.Values[2], -4)
+	checkInteger(t, listVal.Values[3], 1)
+	checkInteger(t, listVal.Values[4], 2)
+	checkInteger(t, listVal.Values[5], -2)
+}
+
+func TestEvalDivisionByZero(t *testing.T) {
+	evalErrorHelper(t, "1 / 0", "1:3: division by zero")
+	evalErrorHelper(t, "1 // 0", "1:3: division by zero")
+	evalErrorHelper(t, "1 % 0", "1:3: division by zero")
+}
+
+func TestEvalNotAndNotEqual(t *testing.T) {
+	val := evalHelper(t, "[not false, not 1 != 1, 1 != 2]")
+
+	listVal := checkList(t, val, 3)
+	checkBool(t, listVal.Values[0], true)
+	checkBool(t, listVal.Values[1], true)
+	checkBool(t, listVal.Values[2], true)
+}
+
+func TestEvalIn(t *testing.T) {
+	input := `
+let m = {"one": 1}
+[2 in [1, 2, 3], 4 in [1, 2, 3], "one" in m, "two" in m, "bc" in "abcd", "x" in "abcd"]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 6)
+	checkBool(t, listVal.Values[0], true)
+	checkBool(t, listVal.Values[1], false)
+	checkBool(t, listVal.Values[2], true)
+	checkBool(t, listVal.Values[3], false)
+	checkBool(t, listVal.Values[4], true)
+	checkBool(t, listVal.Values[5], false)
+}
+
+func TestEvalOperatorTypeErrors(t *testing.T) {
+	evalErrorHelper(t, "1 in 2", "1:3: right operand of in must be a list, map, string or iterator")
+	evalErrorHelper(t, "1 in \"abc\"",
+		"1:3: left operand of in must be a string when right operand is a string")
+	evalErrorHelper(t, "not 1", "1:1: not takes boolean operand")
+	evalErrorHelper(t, "true % 2", "1:6: unsupported operand types for %: bool and int")
+	evalErrorHelper(t, "true // 2", "1:6: unsupported operand types for //: bool and int")
+}
+
+func TestEvalAndOr(t *testing.T) {
+	val := evalHelper(t, "[true and false, true and true, false or true, false or false]")
+
+	listVal := checkList(t, val, 4)
+	checkBool(t, listVal.Values[0], false)
+	checkBool(t, listVal.Values[1], true)
+	checkBool(t, listVal.Values[2], true)
+	checkBool(t, listVal.Values[3], false)
+}
+
+func TestEvalShortCircuit(t *testing.T) {
+	input := `
+let lst = [0]
+
+fn mark(lst) {
+	lst[0] = lst[0] + 1
+	return true
+}
+
+let a = false and [][0]
+let b = true or 1 // 0
+let c = false and mark(lst)
+let d = true or mark(lst)
+let e = true and mark(lst)
+let f = false or mark(lst)
+[a, b, lst[0]]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 3)
+	checkBool(t, listVal.Values[0], false)
+	checkBool(t, listVal.Values[1], true)
+	checkInteger(t, listVal.Values[2], 2)
+}
+
+func TestEvalAndOrTypeErrors(t *testing.T) {
+	evalErrorHelper(t, "1 and true", "1:3: and takes boolean operands")
+	evalErrorHelper(t, "1 or true", "1:3: or takes boolean operands")
+	evalErrorHelper(t, "if 1 {\n\t2\n}", "1:1: condition must be a boolean")
+}
+
+func TestEvalNone(t *testing.T) {
+	val := evalHelper(t, "none")
+
+	_, ok := val.(*data.TorinoNone)
+	if !ok {
+		t.Fatalf("Wrong Torino type: expected *TorinoNone, got %T", val)
+	}
+}
+
+func TestEvalEquality(t *testing.T) {
+	input := "[1 == 1, \"a\" == \"a\", true == true, none == none, " +
+		"[1, [2, \"b\"]] == [1, [2, \"b\"]], {\"a\": [1], \"b\": none} == {\"b\": none, \"a\": [1]}, " +
+		"1 != 2, \"a\" != \"b\", [1, 2] != [1, 2, 3], {\"a\": 1} != {\"a\": 2}, " +
+		"1 != \"1\", none != false, [] != {}, print == print]"
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 14)
+	for i, elem := range listVal.Values {
+		boolVal, ok := elem.(*data.TorinoBool)
+		if !ok || !boolVal.Value {
+			t.Fatalf("Expected element %d to be true, got %s", i, elem.Repr())
+		}
+	}
+}
+
+func TestEvalSelfReferencingValues(t *testing.T) {
+	input := `
+let x = [1]
+x.append(x)
+let y = [1]
+y.append(y)
+let m = {"a": 1}
+m["self"] = m
+[x == x, x == y, x == [1, x], m == m, x == [1, [2]], str(x), str(m), str([x, x])]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 8)
+	checkBool(t, listVal.Values[0], true)
+	checkBool(t, listVal.Values[1], true)
+	checkBool(t, listVal.Values[2], true)
+	checkBool(t, listVal.Values[3], true)
+	checkBool(t, listVal.Values[4], false)
+	checkString(t, listVal.Values[5], "[1, [...]]")
+	checkString(t, listVal.Values[6], "{\"a\": 1, \"self\": {...}}")
+	// A list that appears twice without containing itself is printed in full.
+	checkString(t, listVal.Values[7], "[[1, [...]], [1, [...]]]")
+}
+
+func TestEvalMismatchedTypesAreNotEqual(t *testing.T) {
+	val := evalHelper(t, "[1 == \"1\", none == false, [1] == 1, 0 == false]")
+
+	listVal := checkList(t, val, 4)
+	for i, elem := range listVal.Values {
+		boolVal, ok := elem.(*data.TorinoBool)
+		if !ok || boolVal.Value {
+			t.Fatalf("Expected element %d to be false, got %s", i, elem.Repr())
+		}
+	}
+}
+
+func TestEvalInUsesStructuralEquality(t *testing.T) {
+	val := evalHelper(t, "[[1, 2] in [[1, 2]], none in [1, none], 1 in [\"1\"]]")
+
+	listVal := checkList(t, val, 3)
+	checkBool(t, listVal.Values[0], true)
+	checkBool(t, listVal.Values[1], true)
+	checkBool(t, listVal.Values[2], false)
+}
+
+func TestEvalStringConcatenation(t *testing.T) {
+	input := `
+let key = "to"
+key + ": " + "4"
+`
+	val := evalHelper(t, input)
+
+	checkString(t, val, "to: 4")
+}
+
+func TestEvalStringRepetition(t *testing.T) {
+	val := evalHelper(t, "[\"ab\" * 3, 2 * \"c\", \"ab\" * 0, \"ab\" * -1]")
+
+	listVal := checkList(t, val, 4)
+	checkString(t, listVal.Values[0], "ababab")
+	checkString(t, listVal.Values[1], "cc")
+	checkString(t, listVal.Values[2], "")
+	checkString(t, listVal.Values[3], "")
+
+	evalErrorHelper(t, "\"ab\" * 9223372036854775807", "1:6: repeated string is too long")
+	evalErrorHelper(t, "4611686018427387904 * \"ab\"", "1:21: repeated string is too long")
+	evalErrorHelper(t, "\"ab\" * 4611686018427387903", "1:6: repeated string is too long")
+	evalErrorHelper(t, "\"a\" * 1073741825", "1:5: repeated string is too long")
+	checkString(t, evalHelper(t, "\"\" * 9223372036854775807"), "")
+}
+
+func TestEvalStringComparison(t *testing.T) {
+	input := "[\"abc\" < \"abd\", \"b\" > \"abc\", \"a\" <= \"a\", \"a\" >= \"b\", \"\" < \"a\"]"
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 5)
+	checkBool(t, listVal.Values[0], true)
+	checkBool(t, listVal.Values[1], true)
+	checkBool(t, listVal.Values[2], true)
+	checkBool(t, listVal.Values[3], false)
+	checkBool(t, listVal.Values[4], true)
+}
+
+func TestEvalListConcatenation(t *testing.T) {
+	input := `
+let a = [1, 2]
+let b = a + [3]
+[a, b]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 2)
+	checkList(t, listVal.Values[0], 2)
+	b := checkList(t, listVal.Values[1], 3)
+	checkInteger(t, b.Values[0], 1)
+	checkInteger(t, b.Values[2], 3)
+}
+
+func TestEvalArithmeticTypeErrors(t *testing.T) {
+	evalErrorHelper(t, "\"a\" + 1", "1:5: unsupported operand types for +: string and int")
+	evalErrorHelper(t, "[1] + \"a\"", "1:5: unsupported operand types for +: list and string")
+	evalErrorHelper(t, "\"a\" - \"b\"", "1:5: unsupported operand types for -: string and string")
+	evalErrorHelper(t, "\"a\" * \"b\"", "1:5: unsupported operand types for *: string and string")
+	evalErrorHelper(t, "\"a\" < 1", "1:5: unsupported operand types for <: string and int")
+	evalErrorHelper(t, "none >= none", "1:6: unsupported operand types for >=: none and none")
+}
+
+func TestEvalFunctionArgumentOrder(t *testing.T) {
+	input := `
+fn sub(x, y) {
+	return x - y
+}
+sub(50, 8)
+`
+	val := evalHelper(t, input)
+
+	checkInteger(t, val, 42)
+}
+
+func TestEvalStringMethods(t *testing.T) {
+	input := `
+let words = "To strive, to seek".split()
+[words.len(), words[1], "a,b".split(","), "-".join(["a", "b"]), " Ab ".strip().upper(), "abc".contains("bc")]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 6)
+	checkInteger(t, listVal.Values[0], 4)
+	checkString(t, listVal.Values[1], "strive,")
+	parts := checkList(t, listVal.Values[2], 2)
+	checkString(t, parts.Values[0], "a")
+	checkString(t, parts.Values[1], "b")
+	checkString(t, listVal.Values[3], "a-b")
+	checkString(t, listVal.Values[4], "AB")
+	checkBool(t, listVal.Values[5], true)
+}
+
+func TestEvalListMethods(t *testing.T) {
+	input := `
+let lst = [1, 2]
+lst.append(3)
+lst.append(4)
+let last = lst.pop()
+[lst.len(), last, lst.contains(3), lst.contains(4)]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 4)
+	checkInteger(t, listVal.Values[0], 3)
+	checkInteger(t, listVal.Values[1], 4)
+	checkBool(t, listVal.Values[2], true)
+	checkBool(t, listVal.Values[3], false)
+}
+
+func TestEvalMapMethods(t *testing.T) {
+	input := `
+let m = {"b": 2, "a": 1}
+m["c"] = 3
+[m.len(), m.keys(), m.values(), m.contains("a"), m.contains("z")]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 5)
+	checkInteger(t, listVal.Values[0], 3)
+	keys := checkList(t, listVal.Values[1], 3)
+	checkString(t, keys.Values[0], "b")
+	checkString(t, keys.Values[1], "a")
+	checkString(t, keys.Values[2], "c")
+	values := checkList(t, listVal.Values[2], 3)
+	checkInteger(t, values.Values[0], 2)
+	checkInteger(t, values.Values[1], 1)
+	checkInteger(t, values.Values[2], 3)
+	checkBool(t, listVal.Values[3], true)
+	checkBool(t, listVal.Values[4], false)
+}
+
+func TestEvalBoundMethod(t *testing.T) {
+	input := `
+let lst = []
+let push = lst.append
+push(42)
+lst[0]
+`
+	val := evalHelper(t, input)
+
+	checkInteger(t, val, 42)
+}
+
+func TestEvalMethodErrors(t *testing.T) {
+	evalErrorHelper(t, "1.len()", "1:1: int has no method len")
+	evalErrorHelper(t, "\"abc\".append(1)", "1:1: string has no method append")
+	evalErrorHelper(t, "[].foo", "1:1: list has no method foo")
+	evalErrorHelper(t, "[].len(1)", "1:1: list.len takes no arguments")
+	evalErrorHelper(t, "[].pop()", "1:1: pop from empty list")
+}
+
+func TestEvalForLoopOverMap(t *testing.T) {
+	input := `
+let m = {"a": 1, "b": 2, "c": 3}
+let keys = ""
+let total = 0
+for key in m {
+	keys += key
+}
+for k, v in m {
+	total += v
+	m[k] = v * 10
+}
+[keys.len(), "b" in keys, total, m["c"]]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 4)
+	checkInteger(t, listVal.Values[0], 3)
+	checkBool(t, listVal.Values[1], true)
+	checkInteger(t, listVal.Values[2], 6)
+	checkInteger(t, listVal.Values[3], 30)
+}
+
+func TestEvalForLoopOverString(t *testing.T) {
+	input := `
+let m = {}
+for c in "abcb" {
+	m[c] = 0
+}
+for i, char in "abcb" {
+	m[char] += i
+}
+[m.len(), m["a"], m["b"], m["c"]]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 4)
+	checkInteger(t, listVal.Values[0], 3)
+	checkInteger(t, listVal.Values[1], 0)
+	checkInteger(t, listVal.Values[2], 4)
+	checkInteger(t, listVal.Values[3], 2)
+}
+
+func TestEvalForLoopOverNonASCIIString(t *testing.T) {
+	input := `
+let chars = []
+let last = 0
+for i, c in "héllo, 世界" {
+	chars.append(c)
+	last = i
+}
+[chars, last]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 2)
+	chars := checkList(t, listVal.Values[0], 9)
+	for i, expected := range []string{"h", "é", "l", "l", "o", ",", " ", "世", "界"} {
+		checkString(t, chars.Values[i], expected)
+	}
+	checkInteger(t, listVal.Values[1], 8)
+}
+
+func TestEvalNonASCIIStringIndexAndLength(t *testing.T) {
+	input := `
+let s = "héllo, 世界"
+let matches = true
+for i, c in s {
+	if s[i] != c {
+		matches = false
+	}
+}
+[len(s), s.len(), s[1], s[8], matches]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 5)
+	checkInteger(t, listVal.Values[0], 9)
+	checkInteger(t, listVal.Values[1], 9)
+	checkString(t, listVal.Values[2], "é")
+	checkString(t, listVal.Values[3], "界")
+	checkBool(t, listVal.Values[4], true)
+
+	evalErrorHelper(t, "\"héllo\"[5]", "1:1: index out of bounds")
+}
+
+func TestEvalForLoopWithIndex(t *testing.T) {
+	input := `
+let lst = [10, 20, 30]
+let total = 0
+for i, x in lst {
+	total += i * x
+}
+total
+`
+	val := evalHelper(t, input)
+
+	checkInteger(t, val, 80)
+}
+
+func TestEvalForLoopDoesNotConsumeList(t *testing.T) {
+	input := `
+let lst = [1, 2, 3]
+let order = []
+for x in lst {
+	order.append(x)
+}
+for y in lst {
+	order.append(y)
+}
+[lst, order]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 2)
+	lst := checkList(t, listVal.Values[0], 3)
+	checkInteger(t, lst.Values[0], 1)
+	order := checkList(t, listVal.Values[1], 6)
+	for i, expected := range []int{1, 2, 3, 1, 2, 3} {
+		checkInteger(t, order.Values[i], expected)
+	}
+}
+
+func TestEvalForLoopOverMapInInsertionOrder(t *testing.T) {
+	input := `
+let m = {"b": 2, "a": 1}
+m["c"] = 3
+let order = ""
+for k, v in m {
+	order += k + "=" + "x" * v + " "
+}
+order
+`
+	val := evalHelper(t, input)
+
+	checkString(t, val, "b=xx a=x c=xxx ")
+}
+
+func TestEvalRange(t *testing.T) {
+	input := `
+let out = []
+for i in range(3) {
+	out.append(i)
+}
+for j in range(10, 0, -4) {
+	out.append(j)
+}
+let r = range(1, 3)
+for k in r {
+	out.append(k)
+}
+[out, 2 in range(5), 5 in range(5)]
+`
+	val := evalHelper(t, input)
+
+	listVal := checkList(t, val, 3)
+	out := checkList(t, listVal.Values[0], 8)
+	for i, expected := range []int{0, 1, 2, 10, 6, 2, 1, 2} {
+		checkInteger(t, out.Values[i], expected)
+	}
+	checkBool(t, listVal.Values[1], true)
+	checkBool(t, listVal.Values[2], false)
+}
+
+func TestEvalForLoopErrors(t *testing.T) {
+	evalErrorHelper(t, "for x in 42 {\n}", "1:1: int is not iterable")
+	evalErrorHelper(t, "for x, y in none {\n}", "1:1: none is not iterable")
+	evalErrorHelper(t, "for x, y, z in [] {\n}", "1:11: for loop takes at most two loop variables")
+	evalErrorHelper(t, "range(1, 5, 0)", "1:1: range step cannot be zero")
+}
+
+func TestEvalErrorLocations(t *testing.T) {
+	evalErrorHelper(t, "let x = 1\nlet y = )", "2:9: unexpected token TOKEN_RPAREN")
+	evalErrorHelper(t, "fn f(x) {\n\treturn x // 0\n}\n\nf(1)", "2:11: division by zero")
+	evalErrorHelper(t, "fn f() {\n\treturn\n}\nf() + 1",
+		"4:5: unsupported operand types for +: none and int")
+}
+
+func TestEvalMultipleSyntaxErrors(t *testing.T) {
+	input := "let x = )\nlet y = 1\nif y > ) {\n\tprintln(y)\n}\nlet = 2"
+	evalErrorHelper(t, input, "1:9: unexpected token TOKEN_RPAREN\n"+
+		"3:8: unexpected token TOKEN_RPAREN\n"+
+		"6:5: expected symbol while parsing let statement")
+}
+
+func TestEvalTraceback(t *testing.T) {
+	input := `
+fn countdown(n) {
+	if n == 0 {
+		return 1 // n
+	}
+	return countdown(n - 1)
+}
+
+countdown(2)
+`
+	_, err := Eval(input, vm.NewEnv(nil))
+	rerr, ok := err.(*errs.RuntimeError)
+	if !ok {
+		t.Fatalf("Wrong error type: expected *RuntimeError, got %T", err)
+	}
+
+	expected := []string{"<program> 9:1", "countdown 6:9", "countdown 6:9", "countdown 4:12"}
+	if len(rerr.Traceback) != len(expected) {
+		t.Fatalf("Wrong traceback length: expected %d, got %d",
+			len(expected), len(rerr.Traceback))
+	}
+
+	for i, frame := range rerr.Traceback {
+		got := fmt.Sprintf("%s %s", frame.Function, frame.Loc)
+		if got != expected[i] {
+			t.Fatalf("Wrong traceback frame: expected %q, got %q", expected[i], got)
+		}
+	}
+}
+
+func TestEvalErrorKinds(t *testing.T) {
+	tests := []struct {
+		input string
+		kind  string
+		code  string
+	}{
+		{"let x = )", "SyntaxError", errs.CODE_UNEXPECTED_TOKEN},
+		{"break", "CompileError", errs.CODE_OUTSIDE_LOOP},
+		{"[1][5]", "RuntimeError", errs.CODE_INDEX},
+		{"undefined_name", "CompileError", errs.CODE_UNDEFINED_NAME},
+		{"let x = 1\nlet x = 2", "CompileError", errs.CODE_REDEFINITION},
+		{"1.foo()", "RuntimeError", errs.CODE_NAME},
+		{"1 // 0", "RuntimeError", errs.CODE_DIVISION_BY_ZERO},
+		{"[].len(1)", "RuntimeError", errs.CODE_ARGUMENTS},
+	}
+
+	for _, tt := range tests {
+		_, err := Eval(tt.input, vm.NewEnv(nil))
+		if list, ok := err.(errs.ErrorList); ok {
+			err = list[0]
+		}
+
+		terr, ok := err.(errs.TorinoError)
+		if !ok {
+			t.Fatalf("Wrong error type for %q: expected TorinoError, got %T", tt.input, err)
+		}
+
+		if terr.Kind() != tt.kind || terr.Code() != tt.code {
+			t.Fatalf("Wrong error for %q: expected %s %s, got %s %s",
+				tt.input, tt.kind, tt.code, terr.Kind(), terr.Code())
+		}
+	}
+}
+
+func TestCompileUseBeforeLet(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"println(x)\nlet x = 1", "1:9: undefined symbol x"},
+		{"let x = x + 1", "1:9: undefined symbol x"},
+		{"if true {\n\tprintln(x)\n}\nlet x = 1", "2:10: undefined symbol x"},
+		{"f()\nfn f() {\n}", "1:1: undefined symbol f"},
+	}
+
+	// The errors are reported without running the program.
+	for _, tt := range tests {
+		_, err := Compile(tt.input)
+		cerr, ok := err.(*errs.CompileError)
+		if !ok || cerr.Code() != errs.CODE_UNDEFINED_NAME || cerr.Error() != tt.expected {
+			t.Fatalf("Wrong error for %q: expected %q, got %v", tt.input, tt.expected, err)
+		}
+	}
+
+	// Functions may refer to globals that are declared after them.
+	val := evalHelper(t, "fn f() {\n\treturn g() + x\n}\nfn g() {\n\treturn 1\n}\nlet x = 2\nf()")
+	checkInteger(t, val, 3)
+}
+
+func TestCompileConstantAndNameTables(t *testing.T) {
+	input := `
+let x = 1
+let y = "a"
+fn f(z) {
+	return z + 1
+}
+x + f(1) + y.len() + 1
+`
+	p := parser.New(lexer.New(input))
+	tree, ok := p.Parse()
+	if !ok {
+		t.Fatalf("Parse error: %s", p.Errors()[0])
+	}
+
+	code, err := compiler.New().Compile(tree)
+	if err != nil {
+		t.Fatalf("Compile error: %s", err)
+	}
+
+	// The integer 1 is shared, and the function gets a slot of its own.
+	if len(code.Constants) != 3 {
+		t.Fatalf("Wrong number of constants: expected 3, got %d", len(code.Constants))
+	}
+
+	expectedNames := []string{"x", "y", "f", "len"}
+	if strings.Join(code.Names, " ") != strings.Join(expectedNames, " ") {
+		t.Fatalf("Wrong names: expected %v, got %v", expectedNames, code.Names)
+	}
+
+	// Parameters are locals, so they are not in the name table.
+	f := code.Constants[2].(*compiler.TorinoFunction)
+	if len(f.Body.Constants) != 2 || len(f.Body.Names) != 0 ||
+		len(f.Body.LocalNames) != 1 || f.Body.LocalNames[0] != "z" {
+		t.Fatalf("Wrong tables for function body: %v, %v, %v",
+			f.Body.Constants, f.Body.Names, f.Body.LocalNames)
+	}
+}
+
+func TestModuleRoundTrip(t *testing.T) {
+	input := `
+fn fib(n) {
+	if n < 2 {
+		return n
+	}
+	return fib(n - 1) + fib(n - 2)
+}
+
+fn adder(n) {
+	return fn(x) { return x + n }
+}
+
+let words = {"a": true, "b": none}
+let total = 0
+for i in range(-3, 3) {
+	total += i
+}
+[fib(10), total, words, "done", adder(1)(2)]
+`
+	module := &compiler.Module{"test.tno", compileHelper(t, input)}
+	encoded, err := module.Encode()
+	if err != nil {
+		t.Fatalf("Encode error: %s", err)
+	}
+
+	decoded, err := compiler.DecodeModule(encoded)
+	if err != nil {
+		t.Fatalf("Decode error: %s", err)
+	}
+
+	if decoded.Source != "test.tno" {
+		t.Fatalf("Wrong source path: expected \"test.tno\", got %q", decoded.Source)
+	}
+
+	val, err := vm.New().Execute(decoded.Code, vm.NewEnv(nil))
+	if err != nil {
+		t.Fatalf("Execution error: %s", err)
+	}
+
+	expected := `[55, -3, {"a": true, "b": none}, "done", 3]`
+	if val.Repr() != expected {
+		t.Fatalf("Wrong result: expected %s, got %s", expected, val.Repr())
+	}
+
+	// Locations survive the round trip.
+	module = &compiler.Module{"test.tno", compileHelper(t, "let x = [1]\n\nx[5]")}
+	encoded, err = module.Encode()
+	if err != nil {
+		t.Fatalf("Encode error: %s", err)
+	}
+
+	decoded, err = compiler.DecodeModule(encoded)
+	if err != nil {
+		t.Fatalf("Decode error: %s", err)
+	}
+
+	_, err = vm.New().Execute(decoded.Code, vm.NewEnv(nil))
+	if err == nil || err.Error() != "3:1: index out of bounds" {
+		t.Fatalf("Wrong error from decoded module: %v", err)
+	}
+}
+
+func TestModuleValidation(t *testing.T) {
+	module := &compiler.Module{"test.tno", compileHelper(t, "let x = 1\nx + 1")}
+	encoded, err := module.Encode()
+	if err != nil {
+		t.Fatalf("Encode error: %s", err)
+	}
+
+	corrupted := append([]byte{}, encoded...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	checkDecodeError(t, corrupted, "module checksum does not match: the file is corrupted")
+
+	truncated := encoded[:len(encoded)-4]
+	checkDecodeError(t, truncated, "module checksum does not match: the file is corrupted")
+
+	wrongVersion := append([]byte{}, encoded...)
+	wrongVersion[4] = 99
+	checkDecodeError(t, wrongVersion, "unsupported module version 99 (expected 3)")
+
+	checkDecodeError(t, []byte("print(1)"), "not a compiled Torino module")
+}
+
+func TestModuleStackValidation(t *testing.T) {
+	one := []data.TorinoValue{&data.TorinoInt{1}}
+
+	underflow := compiler.Assemble([]*compiler.Instruction{compiler.NewInst(compiler.POP_STACK)}, nil, nil, nil)
+	checkDecodeError(t, encodeHelper(t, underflow), "stack underflow at offset 0")
+
+	// A function body is checked as well as the program.
+	f := &compiler.TorinoFunction{"f", nil, compiler.Assemble([]*compiler.Instruction{
+		compiler.NewInst(compiler.BINARY_ADD),
+	}, nil, nil, nil)}
+	nested := compiler.Assemble([]*compiler.Instruction{
+		compiler.NewInst(compiler.MAKE_CLOSURE, 0),
+	}, []data.TorinoValue{f}, nil, nil)
+	checkDecodeError(t, encodeHelper(t, nested), "stack underflow at offset 0")
+
+	// Only closures have upvalues, so the program must not refer to any.
+	upvalue := compiler.Assemble([]*compiler.Instruction{
+		compiler.NewInst(compiler.LOAD_UPVALUE, 0),
+	}, nil, nil, nil)
+	upvalue.Upvalues = []compiler.Upvalue{{"x", true, 0}}
+	checkDecodeError(t, encodeHelper(t, upvalue), "program cannot have upvalues")
+
+	// Each parameter is stored in a local variable slot.
+	params := &compiler.TorinoFunction{"f", []string{"x"}, compiler.Assemble([]*compiler.Instruction{
+		compiler.NewInst(compiler.PUSH_CONST, 0),
+		compiler.NewInst(compiler.RETURN_VALUE),
+	}, one, nil, nil)}
+	noLocals := compiler.Assemble([]*compiler.Instruction{
+		compiler.NewInst(compiler.MAKE_CLOSURE, 0),
+	}, []data.TorinoValue{params}, nil, nil)
+	checkDecodeError(t, encodeHelper(t, noLocals),
+		"function has more parameters than local variables at offset 0")
+
+	// The jump reaches the last instruction with an empty stack, but falling through
+	// reaches it with a value on the stack.
+	inconsistent := compiler.Assemble([]*compiler.Instruction{
+		compiler.NewInst(compiler.PUSH_CONST, 0),
+		compiler.NewInst(compiler.REL_JUMP_IF_FALSE, 2),
+		compiler.NewInst(compiler.PUSH_CONST, 0),
+		compiler.NewInst(compiler.PUSH_CONST, 0),
+	}, one, nil, nil)
+	checkDecodeError(t, encodeHelper(t, inconsistent), "inconsistent stack depth at offset 6")
+
+	// Stack depths are valid, but the operand of FOR_ITER is not an iterator.
+	notIterator := compiler.Assemble([]*compiler.Instruction{
+		compiler.NewInst(compiler.PUSH_CONST, 0),
+		compiler.NewInst(compiler.FOR_ITER, 2),
+		compiler.NewInst(compiler.POP_STACK),
+		compiler.NewInst(compiler.POP_STACK),
+	}, one, nil, nil)
+	module, err := compiler.DecodeModule(encodeHelper(t, notIterator))
+	if err != nil {
+		t.Fatalf("Decode error: %s", err)
+	}
+
+	_, err = vm.New().Execute(module.Code, vm.NewEnv(nil))
+	if err == nil || err.Error() != "FOR_ITER requires an iterator" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	input := `
+fn double(x) {
+	return x * 2
+}
+
+let i = 0
+while i < 3 {
+	let step = 1
+	i += step
+}
+double(i)
+`
+	got := compiler.Disassemble(compileHelper(t, input))
+	expected := `Disassembly of <program>:
+   2      0  MAKE_CLOSURE              0 (<function double>)
+          2  DEFINE_GLOBAL             0 (double)
+   6      4  PUSH_CONST                1 (0)
+          6  DEFINE_GLOBAL             1 (i)
+   7      8  PUSH_CONST                2 (3)
+         10  LOAD_GLOBAL               1 (i)
+         12  BINARY_LT
+         13  REL_JUMP_IF_FALSE         +15 (to 28)
+   8     15  PUSH_CONST                3 (1)
+         17  STORE_LOCAL               0 (step)
+   9     19  LOAD_LOCAL                0 (step)
+         21  LOAD_GLOBAL               1 (i)
+         23  BINARY_ADD
+         24  STORE_GLOBAL              1 (i)
+   7     26  REL_JUMP                  -18 (to 8)
+  11     28  LOAD_GLOBAL               1 (i)
+         30  LOAD_GLOBAL               0 (double)
+         32  CALL_FUNCTION             1
+
+Disassembly of double:
+   3      0  PUSH_CONST                0 (2)
+          2  LOAD_LOCAL                0 (x)
+          4  BINARY_MUL
+          5  RETURN_VALUE
+          6  PUSH_CONST                1 (none)
+          8  RETURN_VALUE
+`
+	if got != expected {
+		t.Fatalf("Wrong disassembly: expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestDisassembleClosure(t *testing.T) {
+	input := `
+fn counter() {
+	let n = 0
+	return fn() {
+		n += 1
+		return n
+	}
+}
+`
+	got := compiler.Disassemble(compileHelper(t, input))
+	expected := `Disassembly of <program>:
+   2      0  MAKE_CLOSURE              0 (<function counter>)
+          2  DEFINE_GLOBAL             0 (counter)
+
+Disassembly of counter:
+   3      0  PUSH_CONST                0 (0)
+          2  DEFINE_CELL               0 (n)
+   4      4  MAKE_CLOSURE              1 (<function <anonymous>>)
+          6  RETURN_VALUE
+          7  PUSH_CONST                2 (none)
+          9  RETURN_VALUE
+
+Disassembly of <anonymous>:
+   5      0  PUSH_CONST                0 (1)
+          2  LOAD_UPVALUE              0 (n)
+          4  BINARY_ADD
+          5  STORE_UPVALUE             0 (n)
+   6      7  LOAD_UPVALUE              0 (n)
+          9  RETURN_VALUE
+         10  PUSH_CONST                1 (none)
+         12  RETURN_VALUE
+`
+	if got != expected {
+		t.Fatalf("Wrong disassembly: expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func BenchmarkFibonacci(b *testing.B) {
+	input := `
+fn fib(n) {
+	if n < 2 {
+		return n
+	}
+	return fib(n - 1) + fib(n - 2)
+}
+
+fib(20)
+`
+	benchmarkHelper(b, input)
+}
+
+func BenchmarkWhileLoop(b *testing.B) {
+	input := `
+let total = 0
+let i = 0
+while i < 100000 {
+	total += i * 2 % 7
+	i += 1
+}
+total
+`
+	benchmarkHelper(b, input)
+}
+
+func BenchmarkForLoop(b *testing.B) {
+	input := `
+let lst = []
+for i in range(100000) {
+	if i % 3 == 0 {
+		lst.append(i)
+	}
+}
+lst.len()
+`
+	benchmarkHelper(b, input)
+}
+
+// Helper functions
+
+func compileHelper(t *testing.T, text string) *compiler.TorinoCode {
+	code, err := Compile(text)
+	if err != nil {
+		t.Fatalf("Compile error: %s", err)
+	}
+	return code
+}
+
+func encodeHelper(t *testing.T, code *compiler.TorinoCode) []byte {
+	encoded, err := (&compiler.Module{"test.tno", code}).Encode()
+	if err != nil {
+		t.Fatalf("Encode error: %s", err)
+	}
+	return encoded
+}
+
+func checkDecodeError(t *testing.T, b []byte, expected string) {
+	_, err := compiler.DecodeModule(b)
+	if err == nil {
+		t.Fatalf("Expected decode error %q, got none", expected)
+	}
+
+	if err.Error() != expected {
+		t.Fatalf("Wrong decode error: expected %q, got %q", expected, err.Error())
+	}
+}
+
+func benchmarkHelper(b *testing.B, text string) {
+	for i := 0; i < b.N; i++ {
+		_, err := Eval(text, vm.NewEnv(nil))
+		if err != nil {
+			b.Fatalf("Eval error: %s", err)
+		}
+	}
+}
+
+func evalHelper(t *testing.T, text string) data.TorinoValue {
+	env := vm.NewEnv(nil)
+	val, err := Eval(text, env)
+	if err != nil {
+		t.Fatalf("Eval error: %s", err)
+	}
+	return val
+}
+
+func evalErrorHelper(t *testing.T, text string, expected string) {
+	env := vm.NewEnv(nil)
+	_, err := Eval(text, env)
+	if err == nil {
+		t.Fatalf("Expected eval error %q, got none", expected)
+	}
+
+	if err.Error() != expected {
+		t.Fatalf("Wrong eval error: expected %q, got %q", expected, err.Error())
+	}
+}
+
+func checkInteger(t *testing.T, val data.TorinoValue, expected int) {
+	intVal, ok := val.(*data.TorinoInt)
+	if !ok {
+		t.Fatalf("Wrong Torino type: expected *TorinoInt, got %T", val)
+	}
+
+	if intVal.Value != expected {
+		t.Fatalf("Wrong integer value: expected %d, got %d", expected, intVal.Value)
+	}
+}
+
+func checkBool(t *testing.T, val data.TorinoValue, expected bool) {
+	boolVal, ok := val.(*data.TorinoBool)
+	if !ok {
+		t.Fatalf("Wrong Torino type: expected *TorinoBool, got %T", val)
+	}
+
+	if boolVal.Value != expected {
+		t.Fatalf("Wrong boolean value: expected %t, got %t", expected, boolVal.Value)
 	}
 }
 
@@ -25,6 +25,8 @@ var keywords = map[string]string{
 	"if":       TOKEN_IF,
 	"in":       TOKEN_IN,
 	"let":      TOKEN_LET,
+	"none":     TOKEN_NONE,
+	"not":      TOKEN_NOT,
 	"or":       TOKEN_OR,
 	"return":   TOKEN_RETURN,
 	"true":     TOKEN_TRUE,
@@ -48,20 +50,63 @@ func (l *Lexer) NextToken() *Token {
 	case ',':
 		return l.makeTokenAndAdvance(TOKEN_COMMA, ",")
 	case '+':
-		return l.makeTokenAndAdvance(TOKEN_PLUS, "+")
+		if l.peek('=') {
+			tok := l.makeToken(TOKEN_PLUS_ASSIGN, "+=")
+			l.advance()
+			l.advance()
+			return tok
+		} else {
+			return l.makeTokenAndAdvance(TOKEN_PLUS, "+")
+		}
 	case '-':
-		return l.makeTokenAndAdvance(TOKEN_MINUS, "-")
+		if l.peek('=') {
+			tok := l.makeToken(TOKEN_MINUS_ASSIGN, "-=")
+			l.advance()
+			l.advance()
+			return tok
+		} else {
+			return l.makeTokenAndAdvance(TOKEN_MINUS, "-")
+		}
 	case '*':
-		return l.makeTokenAndAdvance(TOKEN_ASTERISK, "*")
+		if l.peek('=') {
+			tok := l.makeToken(TOKEN_ASTERISK_ASSIGN, "*=")
+			l.advance()
+			l.advance()
+			return tok
+		} else {
+			return l.makeTokenAndAdvance(TOKEN_ASTERISK, "*")
+		}
 	case '/':
-		if l.peek('/') {
+		if strings.HasPrefix(l.program[l.position:], "//=") {
+			tok := l.makeToken(TOKEN_DOUBLE_SLASH_ASSIGN, "//=")
+			l.advance()
+			l.advance()
+			l.advance()
+			return tok
+		} else if l.peek('/') {
 			tok := l.makeToken(TOKEN_DOUBLE_SLASH, "//")
 			l.advance()
 			l.advance()
 			return tok
+		} else if l.peek('=') {
+			tok := l.makeToken(TOKEN_SLASH_ASSIGN, "/=")
+			l.advance()
+			l.advance()
+			return tok
 		} else {
 			return l.makeTokenAndAdvance(TOKEN_SLASH, "/")
 		}
+	case '%':
+		return l.makeTokenAndAdvance(TOKEN_PERCENT, "%")
+	case '!':
+		if l.peek('=') {
+			tok := l.makeToken(TOKEN_NE, "!=")
+			l.advance()
+			l.advance()
+			return tok
+		} else {
+			return l.makeTokenAndAdvance(TOKEN_UNKNOWN, "!")
+		}
 	case '=':
 		if l.peek('=') {
 			tok := l.makeToken(TOKEN_EQ, "==")
@@ -103,32 +148,36 @@ func (l *Lexer) NextToken() *Token {
 		return l.makeTokenAndAdvance(TOKEN_RBRACKET, "]")
 	case ':':
 		return l.makeTokenAndAdvance(TOKEN_COLON, ":")
+	case '.':
+		return l.makeTokenAndAdvance(TOKEN_DOT, ".")
 	case ';':
 		return l.makeTokenAndAdvance(TOKEN_SEMICOLON, ";")
 	case '\n':
 		return l.makeTokenAndAdvance(TOKEN_NEWLINE, "\n")
 	}
 
-	// Multi character tokens
+	// Multi character tokens. The location is recorded before the token is read
+	// so that it points to the token's first character.
+	loc := l.location()
 	switch {
 	case ch == '"':
 		value, ok := l.readString()
 		if ok {
-			return l.makeToken(TOKEN_STRING, value)
+			return &Token{TOKEN_STRING, value, loc}
 		} else {
-			return l.makeToken(TOKEN_UNKNOWN, value)
+			return &Token{TOKEN_UNKNOWN, value, loc}
 		}
 	case canStartIdentifier(ch):
 		value := l.readIdentifier()
 		keywordType, ok := keywords[value]
 		if ok {
-			return l.makeToken(keywordType, value)
+			return &Token{keywordType, value, loc}
 		} else {
-			return l.makeToken(TOKEN_SYMBOL, value)
+			return &Token{TOKEN_SYMBOL, value, loc}
 		}
 	case isDigit(ch):
 		value := l.readInteger()
-		return l.makeToken(TOKEN_INT, value)
+		return &Token{TOKEN_INT, value, loc}
 	default:
 		return l.makeTokenAndAdvance(TOKEN_UNKNOWN, string(ch))
 	}
@@ -139,6 +188,8 @@ func (l *Lexer) advance() {
 		if l.program[l.position] == '\n' {
 			l.line += 1
 			l.column = 1
+		} else {
+			l.column += 1
 		}
 		l.position += 1
 	}
@@ -235,7 +286,11 @@ func (l *Lexer) readComment() bool {
 }
 
 func (l *Lexer) makeToken(typ string, value string) *Token {
-	return &Token{typ, value, &Location{l.line, l.column}}
+	return &Token{typ, value, l.location()}
+}
+
+func (l *Lexer) location() *Location {
+	return &Location{l.line, l.column}
 }
 
 func (l *Lexer) makeTokenAndAdvance(typ string, value string) *Token {
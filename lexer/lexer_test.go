@@ -12,7 +12,7 @@ let x = f(1, 10)
 let s = "\n\c\\\""
 
 /* This isn't valid Torino code but whatever */
-== > < >= <= or and if for while in "" true false
+== != > < >= <= % or and not if for while in "" true false none
 
 /*
 Multiline comment with some tricky delimiters: * /* * /
@@ -64,12 +64,15 @@ Multiline comment with some tricky delimiters: * /* * /
 		{TOKEN_NEWLINE, "\n"},
 		{TOKEN_NEWLINE, "\n"},
 		{TOKEN_EQ, "=="},
+		{TOKEN_NE, "!="},
 		{TOKEN_GT, ">"},
 		{TOKEN_LT, "<"},
 		{TOKEN_GE, ">="},
 		{TOKEN_LE, "<="},
+		{TOKEN_PERCENT, "%"},
 		{TOKEN_OR, "or"},
 		{TOKEN_AND, "and"},
+		{TOKEN_NOT, "not"},
 		{TOKEN_IF, "if"},
 		{TOKEN_FOR, "for"},
 		{TOKEN_WHILE, "while"},
@@ -77,6 +80,7 @@ Multiline comment with some tricky delimiters: * /* * /
 		{TOKEN_STRING, ""},
 		{TOKEN_TRUE, "true"},
 		{TOKEN_FALSE, "false"},
+		{TOKEN_NONE, "none"},
 		{TOKEN_NEWLINE, "\n"},
 		{TOKEN_NEWLINE, "\n"},
 		{TOKEN_EOF, ""},
@@ -97,6 +101,88 @@ Multiline comment with some tricky delimiters: * /* * /
 	}
 }
 
+func TestCompoundAssignmentTokens(t *testing.T) {
+	input := "x += 1 -= 2 *= 3 /= 4 //= 5 // 6 / 7"
+	tests := []struct {
+		expectedType  string
+		expectedValue string
+	}{
+		{TOKEN_SYMBOL, "x"},
+		{TOKEN_PLUS_ASSIGN, "+="},
+		{TOKEN_INT, "1"},
+		{TOKEN_MINUS_ASSIGN, "-="},
+		{TOKEN_INT, "2"},
+		{TOKEN_ASTERISK_ASSIGN, "*="},
+		{TOKEN_INT, "3"},
+		{TOKEN_SLASH_ASSIGN, "/="},
+		{TOKEN_INT, "4"},
+		{TOKEN_DOUBLE_SLASH_ASSIGN, "//="},
+		{TOKEN_INT, "5"},
+		{TOKEN_DOUBLE_SLASH, "//"},
+		{TOKEN_INT, "6"},
+		{TOKEN_SLASH, "/"},
+		{TOKEN_INT, "7"},
+		{TOKEN_EOF, ""},
+	}
+
+	l := New(input)
+	for _, tt := range tests {
+		got := l.NextToken()
+		if got.Type != tt.expectedType {
+			t.Fatalf("Wrong token type: got %q, expected %q",
+				got.Type, tt.expectedType)
+		}
+
+		if got.Value != tt.expectedValue {
+			t.Fatalf("Wrong token value: got %q, expected %q (type %q)",
+				got.Value, tt.expectedValue, got.Type)
+		}
+	}
+}
+
+func TestDotToken(t *testing.T) {
+	l := New("lst.len()")
+	tests := []string{TOKEN_SYMBOL, TOKEN_DOT, TOKEN_SYMBOL, TOKEN_LPAREN, TOKEN_RPAREN, TOKEN_EOF}
+	for _, tt := range tests {
+		got := l.NextToken()
+		if got.Type != tt {
+			t.Fatalf("Wrong token type: got %q, expected %q", got.Type, tt)
+		}
+	}
+}
+
+func TestTokenLocations(t *testing.T) {
+	l := New("let x = \"abc\"\n\tx += 10 /* comment */ y")
+	tests := []struct {
+		expectedType string
+		line         int
+		column       int
+	}{
+		{TOKEN_LET, 1, 1},
+		{TOKEN_SYMBOL, 1, 5},
+		{TOKEN_ASSIGN, 1, 7},
+		{TOKEN_STRING, 1, 9},
+		{TOKEN_NEWLINE, 1, 14},
+		{TOKEN_SYMBOL, 2, 2},
+		{TOKEN_PLUS_ASSIGN, 2, 4},
+		{TOKEN_INT, 2, 7},
+		{TOKEN_SYMBOL, 2, 24},
+		{TOKEN_EOF, 2, 25},
+	}
+
+	for _, tt := range tests {
+		got := l.NextToken()
+		if got.Type != tt.expectedType {
+			t.Fatalf("Wrong token type: got %q, expected %q", got.Type, tt.expectedType)
+		}
+
+		if got.Loc.Line != tt.line || got.Loc.Column != tt.column {
+			t.Fatalf("Wrong location for %q: got %s, expected %d:%d",
+				got.Type, got.Loc, tt.line, tt.column)
+		}
+	}
+}
+
 func TestUnclosedStringLiterals(t *testing.T) {
 	tests := []string{
 		`"`,
@@ -1,5 +1,7 @@
 package lexer
 
+import "fmt"
+
 const (
 	// Keywords
 	TOKEN_BREAK    = "TOKEN_BREAK"
@@ -7,6 +9,7 @@ const (
 	TOKEN_FN       = "TOKEN_FN"
 	TOKEN_FOR      = "TOKEN_FOR"
 	TOKEN_IF       = "TOKEN_IF"
+	TOKEN_NOT      = "TOKEN_NOT"
 	TOKEN_ELIF     = "TOKEN_ELIF"
 	TOKEN_ELSE     = "TOKEN_ELSE"
 	TOKEN_LET      = "TOKEN_LET"
@@ -19,7 +22,9 @@ const (
 	TOKEN_ASTERISK     = "TOKEN_ASTERISK"
 	TOKEN_SLASH        = "TOKEN_SLASH"
 	TOKEN_DOUBLE_SLASH = "TOKEN_DOUBLE_SLASH"
+	TOKEN_PERCENT      = "TOKEN_PERCENT"
 	TOKEN_EQ           = "TOKEN_EQ"
+	TOKEN_NE           = "TOKEN_NE"
 	TOKEN_GT           = "TOKEN_GT"
 	TOKEN_LT           = "TOKEN_LT"
 	TOKEN_GE           = "TOKEN_GE"
@@ -34,11 +39,19 @@ const (
 	TOKEN_STRING = "TOKEN_STRING"
 	TOKEN_TRUE   = "TOKEN_TRUE"
 	TOKEN_FALSE  = "TOKEN_FALSE"
+	TOKEN_NONE   = "TOKEN_NONE"
+
+	TOKEN_ASSIGN              = "TOKEN_ASSIGN"
+	TOKEN_PLUS_ASSIGN         = "TOKEN_PLUS_ASSIGN"
+	TOKEN_MINUS_ASSIGN        = "TOKEN_MINUS_ASSIGN"
+	TOKEN_ASTERISK_ASSIGN     = "TOKEN_ASTERISK_ASSIGN"
+	TOKEN_SLASH_ASSIGN        = "TOKEN_SLASH_ASSIGN"
+	TOKEN_DOUBLE_SLASH_ASSIGN = "TOKEN_DOUBLE_SLASH_ASSIGN"
 
-	TOKEN_ASSIGN    = "TOKEN_ASSIGN"
 	TOKEN_COMMA     = "TOKEN_COMMA"
 	TOKEN_SEMICOLON = "TOKEN_SEMICOLON"
 	TOKEN_COLON     = "TOKEN_COLON"
+	TOKEN_DOT       = "TOKEN_DOT"
 
 	TOKEN_LPAREN   = "TOKEN_LPAREN"
 	TOKEN_RPAREN   = "TOKEN_RPAREN"
@@ -62,3 +75,7 @@ type Location struct {
 	Line   int
 	Column int
 }
+
+func (loc *Location) String() string {
+	return fmt.Sprintf("%d:%d", loc.Line, loc.Column)
+}
@@ -3,44 +3,65 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"github.com/iafisher/torino/compiler"
 	"github.com/iafisher/torino/data"
+	"github.com/iafisher/torino/errs"
 	"github.com/iafisher/torino/eval"
 	"github.com/iafisher/torino/vm"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
 func main() {
 	if len(os.Args) == 1 {
 		repl()
+	} else if os.Args[1] == "compile" {
+		if len(os.Args) != 3 {
+			fmt.Println("Usage: torino compile <file>")
+			return
+		}
+		compileFile(os.Args[2])
+	} else if os.Args[1] == "disasm" {
+		if len(os.Args) != 3 {
+			fmt.Println("Usage: torino disasm <file>")
+			return
+		}
+		disassembleFile(os.Args[2])
 	} else if len(os.Args) == 2 {
-		runFile(os.Args[1])
+		if strings.HasSuffix(os.Args[1], ".tnoc") {
+			runCompiledFile(os.Args[1])
+		} else {
+			runFile(os.Args[1])
+		}
 	} else {
-		fmt.Println("Error: too many command-line arguments supplied.")
+		fmt.Fprintln(os.Stderr, "Error: too many command-line arguments supplied.")
 	}
 }
 
 func repl() {
-	fmt.Println("The Torino programming language.\n")
+	fmt.Println("The Torino programming language.")
+	fmt.Println()
 
-	scanner := bufio.NewScanner(os.Stdin)
+	// The REPL and the input builtin share a reader, so that neither reads ahead of
+	// the other.
+	reader := bufio.NewReader(os.Stdin)
 	env := vm.NewEnv(nil)
+	env.SetStdin(reader)
 	for {
 		fmt.Print(">>> ")
-		scanned := scanner.Scan()
-		if !scanned {
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
 			return
 		}
 
-		line := scanner.Text()
-		oneline(line, env)
+		oneline(strings.TrimRight(line, "\r\n"), env)
 	}
 }
 
 func oneline(text string, env *vm.Environment) {
-	val, err := eval.Eval(text, env)
-	if err != nil {
-		fmt.Println("Error:", err)
+	val, ok := eval.Run(text, "", env)
+	if !ok {
 		return
 	}
 
@@ -53,15 +74,93 @@ func oneline(text string, env *vm.Environment) {
 func runFile(path string) {
 	contents, err := ioutil.ReadFile(path)
 	if err != nil {
-		fmt.Println("Error:", err)
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
+
+	text := string(contents)
+
+	eval.Run(text, path, vm.NewEnv(nil))
+}
+
+// Compile a source file and write the bytecode to a .tnoc file next to it.
+func compileFile(path string) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
 		return
 	}
 
 	text := string(contents)
+	code, err := eval.Compile(text)
+	if err != nil {
+		fmt.Fprint(os.Stderr, errs.Render(err, text, path))
+		return
+	}
+
+	module := &compiler.Module{path, code}
+	encoded, err := module.Encode()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
+
+	err = ioutil.WriteFile(strings.TrimSuffix(path, ".tno")+".tnoc", encoded, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+	}
+}
+
+func runCompiledFile(path string) {
+	module, ok := readModule(path)
+	if !ok {
+		return
+	}
 
 	env := vm.NewEnv(nil)
-	_, err = eval.Eval(text, env)
+	_, err := vm.New().Execute(module.Code, env)
+	if err != nil {
+		// The source is not available, so errors are reported without a snippet.
+		fmt.Fprint(env.Stderr(), errs.Render(err, "", module.Source))
+	}
+}
+
+// Print the bytecode of a source file or of a compiled module.
+func disassembleFile(path string) {
+	if strings.HasSuffix(path, ".tnoc") {
+		module, ok := readModule(path)
+		if ok {
+			fmt.Print(compiler.Disassemble(module.Code))
+		}
+		return
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
+
+	text := string(contents)
+	code, err := eval.Compile(text)
+	if err != nil {
+		fmt.Fprint(os.Stderr, errs.Render(err, text, path))
+		return
+	}
+	fmt.Print(compiler.Disassemble(code))
+}
+
+func readModule(path string) (*compiler.Module, bool) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return nil, false
+	}
+
+	module, err := compiler.DecodeModule(contents)
 	if err != nil {
-		fmt.Println("Error:", err)
+		fmt.Fprintf(os.Stderr, "Error: %s: %s\n", path, err)
+		return nil, false
 	}
+	return module, true
 }
@@ -5,7 +5,12 @@ Version: February 2019
 */
 package parser
 
-type Node interface{}
+import "github.com/iafisher/torino/lexer"
+
+// Every node records the location in the source code where it begins.
+type Node interface {
+	Location() *lexer.Location
+}
 type Expression interface {
 	Node
 	expressionNode()
@@ -21,35 +26,99 @@ type BlockNode struct {
 
 type ExpressionStatement struct {
 	Expr Expression
+	Loc  *lexer.Location
 }
 
 func (n *ExpressionStatement) statementNode() {}
 
+func (n *ExpressionStatement) Location() *lexer.Location {
+	return n.Loc
+}
+
 type LetNode struct {
 	Destination *SymbolNode
 	Value       Expression
+	Loc         *lexer.Location
 }
 
 func (n *LetNode) statementNode() {}
 
+func (n *LetNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type FnNode struct {
 	Symbol *SymbolNode
 	Params []*SymbolNode
 	Body   *BlockNode
+	Loc    *lexer.Location
 }
 
 func (n *FnNode) statementNode() {}
 
+func (n *FnNode) Location() *lexer.Location {
+	return n.Loc
+}
+
+// An anonymous function.
+type FnExpressionNode struct {
+	Params []*SymbolNode
+	Body   *BlockNode
+	Loc    *lexer.Location
+}
+
+func (n *FnExpressionNode) expressionNode() {}
+
+func (n *FnExpressionNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type AssignNode struct {
 	Destination *SymbolNode
 	Value       Expression
+	Loc         *lexer.Location
 }
 
 func (n *AssignNode) statementNode() {}
 
+func (n *AssignNode) Location() *lexer.Location {
+	return n.Loc
+}
+
+// An assignment to an element of a list or map, like `lst[i] = v`.
+type IndexAssignNode struct {
+	Indexed Expression
+	Index   Expression
+	Value   Expression
+	Loc     *lexer.Location
+}
+
+func (n *IndexAssignNode) statementNode() {}
+
+func (n *IndexAssignNode) Location() *lexer.Location {
+	return n.Loc
+}
+
+// An assignment like `x += 1` or `m[k] //= 2`. Op is the corresponding infix
+// operator (e.g., "+" or "//") and Destination is either a *SymbolNode or an
+// *IndexNode.
+type CompoundAssignNode struct {
+	Op          string
+	Destination Expression
+	Value       Expression
+	Loc         *lexer.Location
+}
+
+func (n *CompoundAssignNode) statementNode() {}
+
+func (n *CompoundAssignNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type IfNode struct {
 	Clauses []*IfClause
 	Else    *BlockNode
+	Loc     *lexer.Location
 }
 
 type IfClause struct {
@@ -59,100 +128,206 @@ type IfClause struct {
 
 func (n *IfNode) statementNode() {}
 
+func (n *IfNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type InfixNode struct {
 	Op    string
 	Left  Expression
 	Right Expression
+	Loc   *lexer.Location
 }
 
 func (n *InfixNode) expressionNode() {}
 
+func (n *InfixNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type PrefixNode struct {
 	Op  string
 	Arg Expression
+	Loc *lexer.Location
 }
 
 func (n *PrefixNode) expressionNode() {}
 
+func (n *PrefixNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type CallNode struct {
 	Func    Expression
 	Arglist []Expression
+	Loc     *lexer.Location
 }
 
 func (n *CallNode) expressionNode() {}
 
+func (n *CallNode) Location() *lexer.Location {
+	return n.Loc
+}
+
+// An attribute access like `lst.len`.
+type AttrNode struct {
+	Value Expression
+	Attr  *SymbolNode
+	Loc   *lexer.Location
+}
+
+func (n *AttrNode) expressionNode() {}
+
+func (n *AttrNode) Location() *lexer.Location {
+	return n.Loc
+}
+
+// A for loop has either one or two loop variables. With two variables, a list or
+// string is iterated over as index-element pairs and a map as key-value pairs.
 type ForNode struct {
-	Symbol *SymbolNode
-	Iter   Expression
-	Block  *BlockNode
+	Symbols []*SymbolNode
+	Iter    Expression
+	Block   *BlockNode
+	Loc     *lexer.Location
 }
 
 func (n *ForNode) statementNode() {}
 
+func (n *ForNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type WhileNode struct {
 	Cond  Expression
 	Block *BlockNode
+	Loc   *lexer.Location
 }
 
 func (n *WhileNode) statementNode() {}
 
-type BreakNode struct{}
+func (n *WhileNode) Location() *lexer.Location {
+	return n.Loc
+}
+
+type BreakNode struct {
+	Loc *lexer.Location
+}
 
 func (n *BreakNode) statementNode() {}
 
-type ContinueNode struct{}
+func (n *BreakNode) Location() *lexer.Location {
+	return n.Loc
+}
+
+type ContinueNode struct {
+	Loc *lexer.Location
+}
 
 func (n *ContinueNode) statementNode() {}
 
+func (n *ContinueNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type ReturnNode struct {
 	Value Expression
+	Loc   *lexer.Location
 }
 
 func (n *ReturnNode) statementNode() {}
 
+func (n *ReturnNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type IntegerNode struct {
 	Value int
+	Loc   *lexer.Location
 }
 
 func (n *IntegerNode) expressionNode() {}
 
+func (n *IntegerNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type BoolNode struct {
 	Value bool
+	Loc   *lexer.Location
 }
 
 func (n *BoolNode) expressionNode() {}
 
+func (n *BoolNode) Location() *lexer.Location {
+	return n.Loc
+}
+
+type NoneNode struct {
+	Loc *lexer.Location
+}
+
+func (n *NoneNode) expressionNode() {}
+
+func (n *NoneNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type StringNode struct {
 	Value string
+	Loc   *lexer.Location
 }
 
 func (n *StringNode) expressionNode() {}
 
+func (n *StringNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type SymbolNode struct {
 	Value string
+	Loc   *lexer.Location
 }
 
 func (n *SymbolNode) expressionNode() {}
 
+func (n *SymbolNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type ListNode struct {
 	Values []Expression
+	Loc    *lexer.Location
 }
 
 func (n *ListNode) expressionNode() {}
 
+func (n *ListNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type IndexNode struct {
 	Indexed Expression
 	Index   Expression
+	Loc     *lexer.Location
 }
 
 func (n *IndexNode) expressionNode() {}
 
+func (n *IndexNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type MapNode struct {
 	Values []*MapKeyNode
+	Loc    *lexer.Location
 }
 
 func (n *MapNode) expressionNode() {}
 
+func (n *MapNode) Location() *lexer.Location {
+	return n.Loc
+}
+
 type MapKeyNode struct {
 	Key   Expression
 	Value Expression
@@ -3,11 +3,12 @@
 	start := block
 
 	block := (stmt NEWLINE)*
-	stmt  := let | fn | for | while | if | break | continue | return | expr
+	stmt  := let | fn | for | while | if | break | continue | return | assign | expr
 
 	let      := LET SYMBOL ASSIGN expr
-	fn       := FN SYMBOL LPAREN params? RPAREN brace-block
-	for      := FOR SYMBOL IN expr brace-block
+	assign   := (SYMBOL | index) (ASSIGN | ASSIGN-OP) expr
+	fn       := FN SYMBOL fn-rest
+	for      := FOR SYMBOL (COMMA SYMBOL)? IN expr brace-block
 	while    := WHILE expr brace-block
 	if       := IF expr brace-block elif* else?
 	elif     := ELIF expr brace-block
@@ -17,19 +18,26 @@
 	return   := RETURN expr?
 
 	brace-block := LBRACE NEWLINE block RBRACE
-
-	expr  := infix | call | pexpr | list | map | INT | STRING | SYMBOL | TRUE | FALSE
-	pexpr := LPAREN expr RPAREN
-	infix := expr OP expr
-	call  := SYMBOL LPAREN args? RPAREN
-	list  := LBRACKET args? RBRACKET
-	map   := LBRACKET mapargs? RBRACKET
+	fn-rest     := LPAREN params? RPAREN brace-block
+
+	expr   := infix | prefix | call | index | attr | pexpr | list | map | fnexpr | INT | STRING | SYMBOL | TRUE | FALSE | NONE
+	pexpr  := LPAREN expr RPAREN
+	infix  := expr OP expr
+	prefix := (MINUS | NOT) expr
+	call   := SYMBOL LPAREN args? RPAREN
+	index  := expr LBRACKET expr RBRACKET
+	attr   := expr DOT SYMBOL
+	list   := LBRACKET args? RBRACKET
+	map    := LBRACKET mapargs? RBRACKET
+	fnexpr := FN fn-rest
 
 	params  := (SYMBOL COMMA)* SYMBOL
 	args    := (expr COMMA)* expr
 	mapargs := (maparg COMMA)* maparg
 	maparg  := expr COLON expr
 
+	ASSIGN-OP := += | -= | *= | /= | //=
+
 Infix operators have the usual precedence.
 
 Author:  Ian Fisher (iafisher@protonmail.com)
@@ -39,6 +47,7 @@ package parser
 
 import (
 	"fmt"
+	"github.com/iafisher/torino/errs"
 	"github.com/iafisher/torino/lexer"
 	"strconv"
 )
@@ -46,7 +55,7 @@ import (
 type Parser struct {
 	lexer    *lexer.Lexer
 	curToken *lexer.Token
-	errors   []string
+	errors   []*errs.SyntaxError
 }
 
 func New(l *lexer.Lexer) *Parser {
@@ -60,45 +69,92 @@ func (p *Parser) Parse() (*BlockNode, bool) {
 	return p.parseBlock(true)
 }
 
-func (p *Parser) Errors() []string {
+func (p *Parser) Errors() []*errs.SyntaxError {
 	return p.errors
 }
 
-func (p *Parser) recordError(msg string) {
-	p.errors = append(p.errors, msg)
+// Record an error at the location of the current token.
+func (p *Parser) recordError(code string, msg string) {
+	p.recordErrorAt(p.curToken.Loc, code, msg)
+}
+
+func (p *Parser) recordErrorAt(loc *lexer.Location, code string, msg string) {
+	p.errors = append(p.errors, errs.NewSyntaxError(loc, code, msg))
 }
 
+// Parse a sequence of statements. If a statement cannot be parsed, the error is
+// recorded and the parser skips ahead to the start of the next statement so that
+// later errors are reported as well; in that case, false is returned once the
+// whole block has been parsed.
 func (p *Parser) parseBlock(topLevel bool) (*BlockNode, bool) {
 	statements := []Statement{}
+	failed := false
 	for {
-		stmt, ok := p.parseStatement(topLevel)
-		if !ok {
-			return nil, false
+		if topLevel && p.checkCurToken(lexer.TOKEN_RBRACE) {
+			p.recordError(errs.CODE_UNEXPECTED_TOKEN,
+				fmt.Sprintf("unexpected token %s while parsing block", p.curToken.Type))
+			p.nextToken()
+			failed = true
+		} else {
+			stmt, ok := p.parseStatement()
+			if ok {
+				statements = append(statements, stmt)
+			} else {
+				failed = true
+				p.synchronize()
+			}
 		}
-		statements = append(statements, stmt)
 
 		if p.checkCurToken(lexer.TOKEN_NEWLINE) {
 			p.skipNewlines()
 		} else if p.checkCurToken(lexer.TOKEN_SEMICOLON) {
 			p.nextToken()
 			p.skipNewlines()
-		} else if p.checkCurToken(lexer.TOKEN_EOF) || p.checkCurToken(lexer.TOKEN_RBRACE) {
+		} else if p.checkCurToken(lexer.TOKEN_EOF) {
 			break
+		} else if p.checkCurToken(lexer.TOKEN_RBRACE) {
+			if !topLevel {
+				break
+			}
 		} else {
 			err := fmt.Sprintf("unexpected token %s while parsing block", p.curToken.Type)
-			p.recordError(err)
-			return nil, false
+			p.recordError(errs.CODE_UNEXPECTED_TOKEN, err)
+			failed = true
+			p.synchronize()
+			p.skipNewlines()
 		}
 
-		if p.checkCurToken(lexer.TOKEN_EOF) || p.checkCurToken(lexer.TOKEN_RBRACE) {
+		if p.checkCurToken(lexer.TOKEN_EOF) || (!topLevel && p.checkCurToken(lexer.TOKEN_RBRACE)) {
 			break
 		}
 	}
 
-	return &BlockNode{statements}, true
+	return &BlockNode{statements}, !failed
 }
 
-func (p *Parser) parseStatement(topLevel bool) (Statement, bool) {
+// Skip tokens until the end of the current statement, i.e. a newline or semicolon
+// that is not inside a pair of braces, the closing brace of the enclosing block, or
+// the end of the input.
+func (p *Parser) synchronize() {
+	depth := 0
+	for !p.checkCurToken(lexer.TOKEN_EOF) {
+		if p.checkCurToken(lexer.TOKEN_LBRACE) {
+			depth += 1
+		} else if p.checkCurToken(lexer.TOKEN_RBRACE) {
+			if depth == 0 {
+				return
+			}
+			depth -= 1
+		} else if depth == 0 {
+			if p.checkCurToken(lexer.TOKEN_NEWLINE) || p.checkCurToken(lexer.TOKEN_SEMICOLON) {
+				return
+			}
+		}
+		p.nextToken()
+	}
+}
+
+func (p *Parser) parseStatement() (Statement, bool) {
 	if p.checkCurToken(lexer.TOKEN_LET) {
 		return p.parseLetStatement()
 	} else if p.checkCurToken(lexer.TOKEN_FOR) {
@@ -110,17 +166,15 @@ func (p *Parser) parseStatement(topLevel bool) (Statement, bool) {
 	} else if p.checkCurToken(lexer.TOKEN_RETURN) {
 		return p.parseReturnStatement()
 	} else if p.checkCurToken(lexer.TOKEN_FN) {
-		if !topLevel {
-			p.recordError("function declarations must be at top level")
-			return nil, false
-		}
 		return p.parseFnStatement()
 	} else if p.checkCurToken(lexer.TOKEN_BREAK) {
+		loc := p.curToken.Loc
 		p.nextToken()
-		return &BreakNode{}, true
+		return &BreakNode{loc}, true
 	} else if p.checkCurToken(lexer.TOKEN_CONTINUE) {
+		loc := p.curToken.Loc
 		p.nextToken()
-		return &ContinueNode{}, true
+		return &ContinueNode{loc}, true
 	} else {
 		expr, ok := p.parseExpression(PREC_LOWEST)
 		if !ok {
@@ -128,30 +182,53 @@ func (p *Parser) parseStatement(topLevel bool) (Statement, bool) {
 		}
 
 		if p.checkCurToken(lexer.TOKEN_ASSIGN) {
-			sym, ok := expr.(*SymbolNode)
-			if !ok {
-				p.recordError("cannot assign to non-symbol")
+			p.nextToken()
+			switch dest := expr.(type) {
+			case *SymbolNode:
+				lhs, ok := p.parseExpression(PREC_LOWEST)
+				if !ok {
+					return nil, false
+				}
+				return &AssignNode{dest, lhs, dest.Loc}, true
+			case *IndexNode:
+				lhs, ok := p.parseExpression(PREC_LOWEST)
+				if !ok {
+					return nil, false
+				}
+				return &IndexAssignNode{dest.Indexed, dest.Index, lhs, dest.Loc}, true
+			default:
+				p.recordError(errs.CODE_INVALID_TARGET, "cannot assign to non-symbol")
+				return nil, false
+			}
+		} else if op, ok := compoundAssignOps[p.curToken.Type]; ok {
+			switch expr.(type) {
+			case *SymbolNode, *IndexNode:
+			default:
+				p.recordError(errs.CODE_INVALID_TARGET,
+					fmt.Sprintf("invalid target for %s=", op))
 				return nil, false
 			}
 			p.nextToken()
-			lhs, ok := p.parseExpression(PREC_LOWEST)
+			value, ok := p.parseExpression(PREC_LOWEST)
 			if !ok {
 				return nil, false
 			}
-			return &AssignNode{sym, lhs}, true
+			return &CompoundAssignNode{op, expr, value, expr.Location()}, true
 		} else {
-			return &ExpressionStatement{expr}, true
+			return &ExpressionStatement{expr, expr.Location()}, true
 		}
 	}
 }
 
 func (p *Parser) parseLetStatement() (Statement, bool) {
+	loc := p.curToken.Loc
 	p.nextToken()
 	if p.checkCurToken(lexer.TOKEN_SYMBOL) {
-		dest := &SymbolNode{p.curToken.Value}
+		dest := &SymbolNode{p.curToken.Value, p.curToken.Loc}
 		p.nextToken()
 		if !p.checkCurToken(lexer.TOKEN_ASSIGN) {
-			p.recordError("expected = while parsing let statement")
+			p.recordError(errs.CODE_EXPECTED_TOKEN,
+				"expected = while parsing let statement")
 			return nil, false
 		}
 		p.nextToken()
@@ -159,39 +236,57 @@ func (p *Parser) parseLetStatement() (Statement, bool) {
 		if !ok {
 			return nil, false
 		}
-		return &LetNode{dest, v}, true
+		return &LetNode{dest, v, loc}, true
 	} else {
-		p.recordError("expected symbol while parsing let statement")
+		p.recordError(errs.CODE_EXPECTED_TOKEN,
+			"expected symbol while parsing let statement")
 		return nil, false
 	}
 }
 
 func (p *Parser) parseForStatement() (Statement, bool) {
+	loc := p.curToken.Loc
 	p.nextToken()
-	if p.checkCurToken(lexer.TOKEN_SYMBOL) {
-		sym := &SymbolNode{p.curToken.Value}
-		p.nextToken()
-		if !p.checkCurToken(lexer.TOKEN_IN) {
-			p.recordError("expected in while parsing for loop")
+	symbols := []*SymbolNode{}
+	for {
+		if !p.checkCurToken(lexer.TOKEN_SYMBOL) {
+			p.recordError(errs.CODE_EXPECTED_TOKEN,
+				"expected symbol while parsing for loop")
 			return nil, false
 		}
+		symbols = append(symbols, &SymbolNode{p.curToken.Value, p.curToken.Loc})
 		p.nextToken()
-		iter, ok := p.parseExpression(PREC_LOWEST)
-		if !ok {
-			return nil, false
-		}
-		body, ok := p.parseBracedBlock()
-		if !ok {
-			return nil, false
+
+		if !p.checkCurToken(lexer.TOKEN_COMMA) {
+			break
 		}
-		return &ForNode{sym, iter, body}, true
-	} else {
-		p.recordError("expected symbol while parsing for loop")
+		p.nextToken()
+	}
+
+	if len(symbols) > 2 {
+		p.recordErrorAt(symbols[2].Loc, errs.CODE_LOOP_VARIABLES,
+			"for loop takes at most two loop variables")
+		return nil, false
+	}
+
+	if !p.checkCurToken(lexer.TOKEN_IN) {
+		p.recordError(errs.CODE_EXPECTED_TOKEN, "expected in while parsing for loop")
+		return nil, false
+	}
+	p.nextToken()
+	iter, ok := p.parseExpression(PREC_LOWEST)
+	if !ok {
 		return nil, false
 	}
+	body, ok := p.parseBracedBlock()
+	if !ok {
+		return nil, false
+	}
+	return &ForNode{symbols, iter, body, loc}, true
 }
 
 func (p *Parser) parseWhileStatement() (Statement, bool) {
+	loc := p.curToken.Loc
 	p.nextToken()
 	cond, ok := p.parseExpression(PREC_LOWEST)
 	if !ok {
@@ -201,10 +296,11 @@ func (p *Parser) parseWhileStatement() (Statement, bool) {
 	if !ok {
 		return nil, false
 	}
-	return &WhileNode{cond, body}, true
+	return &WhileNode{cond, body, loc}, true
 }
 
 func (p *Parser) parseIfStatement() (Statement, bool) {
+	loc := p.curToken.Loc
 	p.nextToken()
 	clauses := []*IfClause{}
 
@@ -243,47 +339,83 @@ func (p *Parser) parseIfStatement() (Statement, bool) {
 		}
 	}
 
-	return &IfNode{clauses, elseBody}, true
+	return &IfNode{clauses, elseBody, loc}, true
 }
 
 func (p *Parser) parseReturnStatement() (Statement, bool) {
+	loc := p.curToken.Loc
 	p.nextToken()
 	if p.checkCurToken(lexer.TOKEN_NEWLINE) || p.checkCurToken(lexer.TOKEN_EOF) {
-		return &ReturnNode{nil}, true
+		return &ReturnNode{nil, loc}, true
 	} else {
 		expr, ok := p.parseExpression(PREC_LOWEST)
 		if !ok {
 			return nil, false
 		}
 
-		return &ReturnNode{expr}, true
+		return &ReturnNode{expr, loc}, true
 	}
 }
 
 func (p *Parser) parseFnStatement() (Statement, bool) {
+	loc := p.curToken.Loc
 	p.nextToken()
+	if p.checkCurToken(lexer.TOKEN_LPAREN) {
+		// An anonymous function at the start of an expression statement, e.g. one
+		// that is called immediately.
+		fn, ok := p.parseFnExpression(loc)
+		if !ok {
+			return nil, false
+		}
+
+		expr, ok := p.parseOperators(fn, PREC_LOWEST)
+		if !ok {
+			return nil, false
+		}
+		return &ExpressionStatement{expr, loc}, true
+	}
+
 	if !p.checkCurToken(lexer.TOKEN_SYMBOL) {
-		p.recordError("expected symbol while parsing function declaration")
+		p.recordError(errs.CODE_EXPECTED_TOKEN,
+			"expected symbol while parsing function declaration")
 		return nil, false
 	}
-	sym := &SymbolNode{p.curToken.Value}
+	sym := &SymbolNode{p.curToken.Value, p.curToken.Loc}
 
 	p.nextToken()
-	if !p.checkCurToken(lexer.TOKEN_LPAREN) {
-		p.recordError("expected ( while parsing function declaration")
+	params, body, ok := p.parseFnRest("function declaration")
+	if !ok {
 		return nil, false
 	}
+	return &FnNode{sym, params, body, loc}, true
+}
+
+// Parse an anonymous function, starting from the token after FN.
+func (p *Parser) parseFnExpression(loc *lexer.Location) (*FnExpressionNode, bool) {
+	params, body, ok := p.parseFnRest("function expression")
+	if !ok {
+		return nil, false
+	}
+	return &FnExpressionNode{params, body, loc}, true
+}
+
+// Parse the parameter list and body of a function.
+func (p *Parser) parseFnRest(context string) ([]*SymbolNode, *BlockNode, bool) {
+	if !p.checkCurToken(lexer.TOKEN_LPAREN) {
+		p.recordError(errs.CODE_EXPECTED_TOKEN, fmt.Sprintf("expected ( while parsing %s", context))
+		return nil, nil, false
+	}
 	p.nextToken()
 	params, ok := p.parseParamList()
 	if !ok {
-		return nil, false
+		return nil, nil, false
 	}
 
 	body, ok := p.parseBracedBlock()
 	if !ok {
-		return nil, false
+		return nil, nil, false
 	}
-	return &FnNode{sym, params, body}, true
+	return params, body, true
 }
 
 func (p *Parser) parseExpression(precedence int) (Expression, bool) {
@@ -291,7 +423,11 @@ func (p *Parser) parseExpression(precedence int) (Expression, bool) {
 	if !ok {
 		return nil, false
 	}
+	return p.parseOperators(left, precedence)
+}
 
+// Parse the infix and postfix operators that follow `left`.
+func (p *Parser) parseOperators(left Expression, precedence int) (Expression, bool) {
 	for {
 		// Keep consuming infix operators until we hit either a non-infix token or an
 		// infix operator with a lower precedence.
@@ -304,7 +440,7 @@ func (p *Parser) parseExpression(precedence int) (Expression, bool) {
 						return nil, false
 					}
 
-					left = &CallNode{left, arglist}
+					left = &CallNode{left, arglist, left.Location()}
 				} else if p.checkCurToken(lexer.TOKEN_LBRACKET) {
 					p.nextToken()
 					index, ok := p.parseExpression(PREC_LOWEST)
@@ -313,12 +449,22 @@ func (p *Parser) parseExpression(precedence int) (Expression, bool) {
 					}
 
 					if !p.checkCurToken(lexer.TOKEN_RBRACKET) {
-						p.recordError("expected ] while parsing index expression")
+						p.recordError(errs.CODE_EXPECTED_TOKEN,
+							"expected ] while parsing index expression")
 						return nil, false
 					}
 					p.nextToken()
 
-					left = &IndexNode{left, index}
+					left = &IndexNode{left, index, left.Location()}
+				} else if p.checkCurToken(lexer.TOKEN_DOT) {
+					p.nextToken()
+					if !p.checkCurToken(lexer.TOKEN_SYMBOL) {
+						p.recordError(errs.CODE_EXPECTED_TOKEN, "expected symbol after .")
+						return nil, false
+					}
+					attr := &SymbolNode{p.curToken.Value, p.curToken.Loc}
+					left = &AttrNode{left, attr, left.Location()}
+					p.nextToken()
 				} else {
 					left, ok = p.parseInfix(left, getPrecedence(p.curToken.Type))
 					if !ok {
@@ -339,22 +485,36 @@ func (p *Parser) parseExpression(precedence int) (Expression, bool) {
 func (p *Parser) parsePrefix() (Expression, bool) {
 	typ := p.curToken.Type
 	val := p.curToken.Value
+	loc := p.curToken.Loc
+	// A token that ends a statement or block is left in place, so that the parser can
+	// recover from the error at the end of the incomplete statement rather than at the
+	// end of the next one.
+	if typ == lexer.TOKEN_NEWLINE || typ == lexer.TOKEN_SEMICOLON || typ == lexer.TOKEN_RBRACE ||
+		typ == lexer.TOKEN_EOF {
+		p.recordErrorAt(loc, errs.CODE_UNEXPECTED_TOKEN,
+			fmt.Sprintf("unexpected token %s", typ))
+		return nil, false
+	}
+
 	p.nextToken()
 	if typ == lexer.TOKEN_INT {
 		v, err := strconv.ParseInt(val, 10, 64)
 		if err != nil {
-			p.recordError("could not parse integer token")
+			p.recordErrorAt(loc, errs.CODE_INVALID_INTEGER,
+				"could not parse integer token")
 			return nil, false
 		}
-		return &IntegerNode{int(v)}, true
+		return &IntegerNode{int(v), loc}, true
 	} else if typ == lexer.TOKEN_STRING {
-		return &StringNode{val}, true
+		return &StringNode{val, loc}, true
 	} else if typ == lexer.TOKEN_SYMBOL {
-		return &SymbolNode{val}, true
+		return &SymbolNode{val, loc}, true
 	} else if typ == lexer.TOKEN_TRUE {
-		return &BoolNode{true}, true
+		return &BoolNode{true, loc}, true
 	} else if typ == lexer.TOKEN_FALSE {
-		return &BoolNode{false}, true
+		return &BoolNode{false, loc}, true
+	} else if typ == lexer.TOKEN_NONE {
+		return &NoneNode{loc}, true
 	} else if typ == lexer.TOKEN_LPAREN {
 		expr, ok := p.parseExpression(PREC_LOWEST)
 		if !ok {
@@ -362,7 +522,7 @@ func (p *Parser) parsePrefix() (Expression, bool) {
 		}
 
 		if !p.checkCurToken(lexer.TOKEN_RPAREN) {
-			p.recordError("expected )")
+			p.recordError(errs.CODE_EXPECTED_TOKEN, "expected )")
 			return nil, false
 		}
 
@@ -370,26 +530,33 @@ func (p *Parser) parsePrefix() (Expression, bool) {
 		return expr, true
 	} else if typ == lexer.TOKEN_MINUS {
 		expr, ok := p.parseExpression(PREC_PREFIX)
-		return &PrefixNode{val, expr}, ok
+		return &PrefixNode{val, expr, loc}, ok
+	} else if typ == lexer.TOKEN_NOT {
+		expr, ok := p.parseExpression(PREC_NOT)
+		return &PrefixNode{val, expr, loc}, ok
 	} else if typ == lexer.TOKEN_LBRACKET {
 		values, ok := p.parseArglist(lexer.TOKEN_RBRACKET)
-		return &ListNode{values}, ok
+		return &ListNode{values, loc}, ok
 	} else if typ == lexer.TOKEN_LBRACE {
-		return p.parseMap()
+		return p.parseMap(loc)
+	} else if typ == lexer.TOKEN_FN {
+		return p.parseFnExpression(loc)
 	} else {
-		p.recordError(fmt.Sprintf("unexpected token %s", p.curToken.Type))
+		p.recordErrorAt(loc, errs.CODE_UNEXPECTED_TOKEN,
+			fmt.Sprintf("unexpected token %s", typ))
 		return nil, false
 	}
 }
 
 func (p *Parser) parseInfix(left Expression, precedence int) (Expression, bool) {
 	operator := p.curToken.Value
+	loc := p.curToken.Loc
 	p.nextToken()
 	right, ok := p.parseExpression(precedence)
 	if !ok {
 		return nil, false
 	}
-	return &InfixNode{operator, left, right}, true
+	return &InfixNode{operator, left, right, loc}, true
 }
 
 func (p *Parser) parseArglist(terminator string) ([]Expression, bool) {
@@ -413,8 +580,8 @@ func (p *Parser) parseArglist(terminator string) ([]Expression, bool) {
 			p.nextToken()
 			break
 		} else {
-			p.recordError(fmt.Sprintf("unexpected token %s while parsing argument list",
-				p.curToken.Type))
+			p.recordError(errs.CODE_UNEXPECTED_TOKEN,
+				fmt.Sprintf("unexpected token %s while parsing argument list", p.curToken.Type))
 			return nil, false
 		}
 	}
@@ -431,10 +598,11 @@ func (p *Parser) parseParamList() ([]*SymbolNode, bool) {
 
 	for {
 		if !p.checkCurToken(lexer.TOKEN_SYMBOL) {
-			p.recordError("expected symbol while parsing parameter list")
+			p.recordError(errs.CODE_EXPECTED_TOKEN,
+				"expected symbol while parsing parameter list")
 			return nil, false
 		}
-		paramlist = append(paramlist, &SymbolNode{p.curToken.Value})
+		paramlist = append(paramlist, &SymbolNode{p.curToken.Value, p.curToken.Loc})
 
 		p.nextToken()
 		if p.checkCurToken(lexer.TOKEN_COMMA) {
@@ -443,20 +611,20 @@ func (p *Parser) parseParamList() ([]*SymbolNode, bool) {
 			p.nextToken()
 			break
 		} else {
-			p.recordError(fmt.Sprintf("unexpected token %s while parsing parameter list",
-				p.curToken.Type))
+			p.recordError(errs.CODE_UNEXPECTED_TOKEN,
+				fmt.Sprintf("unexpected token %s while parsing parameter list", p.curToken.Type))
 			return nil, false
 		}
 	}
 	return paramlist, true
 }
 
-func (p *Parser) parseMap() (*MapNode, bool) {
+func (p *Parser) parseMap(loc *lexer.Location) (*MapNode, bool) {
 	values := []*MapKeyNode{}
 	// Special case for empty map.
 	if p.checkCurToken(lexer.TOKEN_RBRACE) {
 		p.nextToken()
-		return &MapNode{values}, true
+		return &MapNode{values, loc}, true
 	}
 
 	for {
@@ -466,7 +634,7 @@ func (p *Parser) parseMap() (*MapNode, bool) {
 		}
 
 		if !p.checkCurToken(lexer.TOKEN_COLON) {
-			p.recordError("expected : while parsing map")
+			p.recordError(errs.CODE_EXPECTED_TOKEN, "expected : while parsing map")
 			return nil, false
 		}
 
@@ -483,17 +651,17 @@ func (p *Parser) parseMap() (*MapNode, bool) {
 		} else if p.checkCurToken(lexer.TOKEN_COMMA) {
 			p.nextToken()
 		} else {
-			p.recordError(fmt.Sprintf("unexpected token %s while parsing map",
-				p.curToken.Type))
+			p.recordError(errs.CODE_UNEXPECTED_TOKEN,
+				fmt.Sprintf("unexpected token %s while parsing map", p.curToken.Type))
 			return nil, false
 		}
 	}
-	return &MapNode{values}, true
+	return &MapNode{values, loc}, true
 }
 
 func (p *Parser) parseBracedBlock() (*BlockNode, bool) {
 	if !p.checkCurToken(lexer.TOKEN_LBRACE) {
-		p.recordError("expected { while parsing block")
+		p.recordError(errs.CODE_EXPECTED_TOKEN, "expected { while parsing block")
 		return nil, false
 	}
 	p.nextToken()
@@ -507,11 +675,16 @@ func (p *Parser) parseBracedBlock() (*BlockNode, bool) {
 
 	block, ok := p.parseBlock(false)
 	if !ok {
+		// Consume the closing brace so that the enclosing block can carry on from
+		// the end of this one.
+		if p.checkCurToken(lexer.TOKEN_RBRACE) {
+			p.nextToken()
+		}
 		return nil, false
 	}
 
 	if !p.checkCurToken(lexer.TOKEN_RBRACE) {
-		p.recordError("expected } while parsing block")
+		p.recordError(errs.CODE_EXPECTED_TOKEN, "expected } while parsing block")
 		return nil, false
 	}
 	p.nextToken()
@@ -547,6 +720,7 @@ const (
 	PREC_LOWEST
 	PREC_OR
 	PREC_AND
+	PREC_NOT
 	PREC_CMP
 	PREC_ADD_SUB
 	PREC_MUL_DIV
@@ -555,17 +729,31 @@ const (
 )
 
 var precedenceMap = map[string]int{
-	lexer.TOKEN_EQ:       PREC_CMP,
-	lexer.TOKEN_GT:       PREC_CMP,
-	lexer.TOKEN_GE:       PREC_CMP,
-	lexer.TOKEN_LT:       PREC_CMP,
-	lexer.TOKEN_LE:       PREC_CMP,
-	lexer.TOKEN_PLUS:     PREC_ADD_SUB,
-	lexer.TOKEN_MINUS:    PREC_ADD_SUB,
-	lexer.TOKEN_ASTERISK: PREC_MUL_DIV,
-	lexer.TOKEN_SLASH:    PREC_MUL_DIV,
-	lexer.TOKEN_LPAREN:   PREC_CALL_INDEX,
-	lexer.TOKEN_LBRACKET: PREC_CALL_INDEX,
-	lexer.TOKEN_AND:      PREC_AND,
-	lexer.TOKEN_OR:       PREC_OR,
+	lexer.TOKEN_EQ:           PREC_CMP,
+	lexer.TOKEN_NE:           PREC_CMP,
+	lexer.TOKEN_GT:           PREC_CMP,
+	lexer.TOKEN_GE:           PREC_CMP,
+	lexer.TOKEN_LT:           PREC_CMP,
+	lexer.TOKEN_LE:           PREC_CMP,
+	lexer.TOKEN_IN:           PREC_CMP,
+	lexer.TOKEN_PLUS:         PREC_ADD_SUB,
+	lexer.TOKEN_MINUS:        PREC_ADD_SUB,
+	lexer.TOKEN_ASTERISK:     PREC_MUL_DIV,
+	lexer.TOKEN_SLASH:        PREC_MUL_DIV,
+	lexer.TOKEN_DOUBLE_SLASH: PREC_MUL_DIV,
+	lexer.TOKEN_PERCENT:      PREC_MUL_DIV,
+	lexer.TOKEN_LPAREN:       PREC_CALL_INDEX,
+	lexer.TOKEN_LBRACKET:     PREC_CALL_INDEX,
+	lexer.TOKEN_DOT:          PREC_CALL_INDEX,
+	lexer.TOKEN_AND:          PREC_AND,
+	lexer.TOKEN_OR:           PREC_OR,
+}
+
+// Maps compound assignment tokens to their corresponding infix operators.
+var compoundAssignOps = map[string]string{
+	lexer.TOKEN_PLUS_ASSIGN:         "+",
+	lexer.TOKEN_MINUS_ASSIGN:        "-",
+	lexer.TOKEN_ASTERISK_ASSIGN:     "*",
+	lexer.TOKEN_SLASH_ASSIGN:        "/",
+	lexer.TOKEN_DOUBLE_SLASH_ASSIGN: "//",
 }
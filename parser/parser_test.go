@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"github.com/iafisher/torino/errs"
 	"github.com/iafisher/torino/lexer"
 	"testing"
 )
@@ -36,6 +37,15 @@ func TestParseBool(t *testing.T) {
 	}
 }
 
+func TestParseNone(t *testing.T) {
+	tree := parseExpressionHelper(t, "none")
+
+	_, ok := tree.(*NoneNode)
+	if !ok {
+		t.Fatalf("Wrong AST type: expected *NoneNode, got %T", tree)
+	}
+}
+
 func TestParseLet(t *testing.T) {
 	tree := parseStatementHelper(t, "let x = 10")
 
@@ -150,6 +160,46 @@ func TestPrefixOp(t *testing.T) {
 	checkInteger(t, minusNode.Arg, 5)
 }
 
+func TestParseNotPrecedence(t *testing.T) {
+	tree := parseExpressionHelper(t, "not x == 1 and y")
+
+	andNode := checkInfix(t, tree, "and")
+	checkSymbol(t, andNode.Right, "y")
+
+	notNode := checkPrefix(t, andNode.Left, "not")
+	eqNode := checkInfix(t, notNode.Arg, "==")
+	checkSymbol(t, eqNode.Left, "x")
+	checkInteger(t, eqNode.Right, 1)
+}
+
+func TestParseFloorDivAndModPrecedence(t *testing.T) {
+	tree := parseExpressionHelper(t, "a + b // 2 % 3")
+
+	addNode := checkInfix(t, tree, "+")
+	checkSymbol(t, addNode.Left, "a")
+
+	modNode := checkInfix(t, addNode.Right, "%")
+	checkInteger(t, modNode.Right, 3)
+
+	divNode := checkInfix(t, modNode.Left, "//")
+	checkSymbol(t, divNode.Left, "b")
+	checkInteger(t, divNode.Right, 2)
+}
+
+func TestParseInAndNotEqual(t *testing.T) {
+	tree := parseExpressionHelper(t, "x in lst or x != 1")
+
+	orNode := checkInfix(t, tree, "or")
+
+	inNode := checkInfix(t, orNode.Left, "in")
+	checkSymbol(t, inNode.Left, "x")
+	checkSymbol(t, inNode.Right, "lst")
+
+	neNode := checkInfix(t, orNode.Right, "!=")
+	checkSymbol(t, neNode.Left, "x")
+	checkInteger(t, neNode.Right, 1)
+}
+
 func TestParseCallExpression(t *testing.T) {
 	tree := parseExpressionHelper(t, "f(x)")
 
@@ -207,6 +257,60 @@ func TestParseAssignNode(t *testing.T) {
 	checkInteger(t, addNode.Right, 1)
 }
 
+func TestParseIndexAssignNode(t *testing.T) {
+	tree := parseStatementHelper(t, "lst[i + 1] = x")
+
+	node, ok := tree.(*IndexAssignNode)
+	if !ok {
+		t.Fatalf("Wrong AST type: expected *IndexAssignNode, got %T", tree)
+	}
+
+	checkSymbol(t, node.Indexed, "lst")
+	addNode := checkInfix(t, node.Index, "+")
+	checkSymbol(t, addNode.Left, "i")
+	checkInteger(t, addNode.Right, 1)
+	checkSymbol(t, node.Value, "x")
+}
+
+func TestParseCompoundAssignNode(t *testing.T) {
+	tree := parseStatementHelper(t, "x //= y + 1")
+
+	node, ok := tree.(*CompoundAssignNode)
+	if !ok {
+		t.Fatalf("Wrong AST type: expected *CompoundAssignNode, got %T", tree)
+	}
+
+	if node.Op != "//" {
+		t.Fatalf("Wrong operator: expected //, got %s", node.Op)
+	}
+
+	checkSymbol(t, node.Destination, "x")
+	addNode := checkInfix(t, node.Value, "+")
+	checkSymbol(t, addNode.Left, "y")
+	checkInteger(t, addNode.Right, 1)
+}
+
+func TestParseCompoundAssignToIndex(t *testing.T) {
+	tree := parseStatementHelper(t, "ret[word] += 1")
+
+	node, ok := tree.(*CompoundAssignNode)
+	if !ok {
+		t.Fatalf("Wrong AST type: expected *CompoundAssignNode, got %T", tree)
+	}
+
+	if node.Op != "+" {
+		t.Fatalf("Wrong operator: expected +, got %s", node.Op)
+	}
+
+	indexNode, ok := node.Destination.(*IndexNode)
+	if !ok {
+		t.Fatalf("Wrong AST type: expected *IndexNode, got %T", node.Destination)
+	}
+	checkSymbol(t, indexNode.Indexed, "ret")
+	checkSymbol(t, indexNode.Index, "word")
+	checkInteger(t, node.Value, 1)
+}
+
 func TestParseForLoop(t *testing.T) {
 	tree := parseStatementHelper(t, "for c in string {\nprint(c)\n}")
 
@@ -215,7 +319,10 @@ func TestParseForLoop(t *testing.T) {
 		t.Fatalf("Wrong AST type: expected *ForNode, got %T", tree)
 	}
 
-	checkSymbol(t, node.Symbol, "c")
+	if len(node.Symbols) != 1 {
+		t.Fatalf("Wrong number of loop variables: expected 1, got %d", len(node.Symbols))
+	}
+	checkSymbol(t, node.Symbols[0], "c")
 	checkSymbol(t, node.Iter, "string")
 
 	if len(node.Block.Statements) != 1 {
@@ -233,6 +340,22 @@ func TestParseForLoop(t *testing.T) {
 	checkSymbol(t, callNode.Arglist[0], "c")
 }
 
+func TestParseForLoopWithTwoVariables(t *testing.T) {
+	tree := parseStatementHelper(t, "for key, val in m {\nprint(key)\n}")
+
+	node, ok := tree.(*ForNode)
+	if !ok {
+		t.Fatalf("Wrong AST type: expected *ForNode, got %T", tree)
+	}
+
+	if len(node.Symbols) != 2 {
+		t.Fatalf("Wrong number of loop variables: expected 2, got %d", len(node.Symbols))
+	}
+	checkSymbol(t, node.Symbols[0], "key")
+	checkSymbol(t, node.Symbols[1], "val")
+	checkSymbol(t, node.Iter, "m")
+}
+
 func TestParseWhileLoop(t *testing.T) {
 	tree := parseStatementHelper(t, "while x > 0 {\nprint(x)\nx = x - 1\n}")
 
@@ -421,6 +544,61 @@ fn foo(x, y) {
 	checkSymbol(t, infixNode.Right, "y")
 }
 
+func TestParseNestedFunctionDeclaration(t *testing.T) {
+	input := `
+fn outer() {
+	fn inner() {
+		return 1
+	}
+	return inner
+}
+`
+	tree := parseStatementHelper(t, input)
+	node, ok := tree.(*FnNode)
+	if !ok {
+		t.Fatalf("Wrong AST type: expected *FnNode, got %T", tree)
+	}
+
+	inner, ok := node.Body.Statements[0].(*FnNode)
+	if !ok {
+		t.Fatalf("Wrong AST type: expected *FnNode, got %T", node.Body.Statements[0])
+	}
+	checkSymbol(t, inner.Symbol, "inner")
+}
+
+func TestParseFunctionExpression(t *testing.T) {
+	tree := parseExpressionHelper(t, "map(fn(x) { return x * 2 }, lst)")
+
+	callNode := checkCall(t, tree, "map", 2)
+	fnNode, ok := callNode.Arglist[0].(*FnExpressionNode)
+	if !ok {
+		t.Fatalf("Wrong AST type: expected *FnExpressionNode, got %T", callNode.Arglist[0])
+	}
+
+	if len(fnNode.Params) != 1 {
+		t.Fatalf("Wrong number of parameters: expected 1, got %d", len(fnNode.Params))
+	}
+	checkSymbol(t, fnNode.Params[0], "x")
+
+	if len(fnNode.Body.Statements) != 1 {
+		t.Fatalf("Wrong number of statements in function body: expected 1, got %d",
+			len(fnNode.Body.Statements))
+	}
+	checkSymbol(t, callNode.Arglist[1], "lst")
+	checkLocation(t, fnNode, 1, 5)
+}
+
+func TestParseImmediatelyCalledFunctionExpression(t *testing.T) {
+	tree := parseExpressionHelper(t, "fn(x) { return x }(1) + 1")
+
+	addNode := checkInfix(t, tree, "+")
+	callNode := checkCall(t, addNode.Left, "", 1)
+	if _, ok := callNode.Func.(*FnExpressionNode); !ok {
+		t.Fatalf("Wrong AST type: expected *FnExpressionNode, got %T", callNode.Func)
+	}
+	checkInteger(t, addNode.Right, 1)
+}
+
 func TestParseBreakAndContinue(t *testing.T) {
 	tree := parseHelper(t, "break\ncontinue")
 	if len(tree.Statements) != 2 {
@@ -439,6 +617,24 @@ func TestParseBreakAndContinue(t *testing.T) {
 	}
 }
 
+func TestParseMethodCall(t *testing.T) {
+	tree := parseExpressionHelper(t, "\"a b\".split(sep)[0].len()")
+
+	callNode := checkCall(t, tree, "", 0)
+	lenNode := checkAttr(t, callNode.Func, "len")
+
+	indexNode, ok := lenNode.Value.(*IndexNode)
+	if !ok {
+		t.Fatalf("Wrong AST type: expected *IndexNode, got %T", lenNode.Value)
+	}
+	checkInteger(t, indexNode.Index, 0)
+
+	splitCall := checkCall(t, indexNode.Indexed, "", 1)
+	checkSymbol(t, splitCall.Arglist[0], "sep")
+	splitNode := checkAttr(t, splitCall.Func, "split")
+	checkString(t, splitNode.Value, "a b")
+}
+
 func TestParseList(t *testing.T) {
 	tree := parseExpressionHelper(t, "[1, 2, 3]")
 
@@ -537,6 +733,90 @@ func TestEmptyMapLiteral(t *testing.T) {
 	checkMap(t, tree, 0)
 }
 
+func TestNodeLocations(t *testing.T) {
+	tree := parseHelper(t, "let x = 1\nif x > 0 {\n\tf(x)[0]\n}")
+
+	checkLocation(t, tree.Statements[0], 1, 1)
+	letNode := tree.Statements[0].(*LetNode)
+	checkLocation(t, letNode.Destination, 1, 5)
+	checkLocation(t, letNode.Value, 1, 9)
+
+	checkLocation(t, tree.Statements[1], 2, 1)
+	ifNode := tree.Statements[1].(*IfNode)
+	checkLocation(t, ifNode.Clauses[0].Cond, 2, 6)
+
+	expr := ifNode.Clauses[0].Body.Statements[0].(*ExpressionStatement).Expr
+	checkLocation(t, expr, 3, 2)
+	checkLocation(t, expr.(*IndexNode).Index, 3, 7)
+}
+
+func TestParseErrorLocation(t *testing.T) {
+	p := New(lexer.New("let x = 1\nlet y = )"))
+	_, ok := p.Parse()
+	if ok {
+		t.Fatalf("Expected parse error, got none")
+	}
+
+	expected := "2:9: unexpected token TOKEN_RPAREN"
+	if p.Errors()[0].Error() != expected {
+		t.Fatalf("Wrong parse error: expected %q, got %q", expected, p.Errors()[0])
+	}
+
+	if p.Errors()[0].Code() != errs.CODE_UNEXPECTED_TOKEN {
+		t.Fatalf("Wrong error code: expected %s, got %s",
+			errs.CODE_UNEXPECTED_TOKEN, p.Errors()[0].Code())
+	}
+}
+
+func TestParseErrorRecovery(t *testing.T) {
+	input := `
+let a = )
+fn f() {
+	let = 1
+	return 1 +
+}
+f(1, 2; let b = [1 2]
+}
+while true {
+	fn 5() {}
+}
+let c =
+let d = )
+let e = 1 +
+let f = )
+let g = 3
+`
+	p := New(lexer.New(input))
+	_, ok := p.Parse()
+	if ok {
+		t.Fatalf("Expected parse errors, got none")
+	}
+
+	expected := []string{
+		"2:9: unexpected token TOKEN_RPAREN",
+		"4:6: expected symbol while parsing let statement",
+		"5:12: unexpected token TOKEN_NEWLINE",
+		"7:7: unexpected token TOKEN_SEMICOLON while parsing argument list",
+		"7:20: unexpected token TOKEN_INT while parsing argument list",
+		"8:1: unexpected token TOKEN_RBRACE while parsing block",
+		"10:5: expected symbol while parsing function declaration",
+		"12:8: unexpected token TOKEN_NEWLINE",
+		"13:9: unexpected token TOKEN_RPAREN",
+		"14:12: unexpected token TOKEN_NEWLINE",
+		"15:9: unexpected token TOKEN_RPAREN",
+	}
+	if len(p.Errors()) != len(expected) {
+		t.Fatalf("Wrong number of parse errors: expected %d, got %d (%v)",
+			len(expected), len(p.Errors()), p.Errors())
+	}
+
+	for i, err := range p.Errors() {
+		if err.Error() != expected[i] {
+			t.Fatalf("Wrong parse error: expected %q, got %q", expected[i], err.Error())
+		}
+	}
+}
+
 // Helper functions
 
 func parseHelper(t *testing.T, input string) *BlockNode {
@@ -664,6 +944,19 @@ func checkCall(t *testing.T, n Node, sym string, nargs int) *CallNode {
 	return callNode
 }
 
+func checkAttr(t *testing.T, n Node, attr string) *AttrNode {
+	node, ok := n.(*AttrNode)
+	if !ok {
+		t.Fatalf("Wrong AST type: expected *AttrNode, got %T", n)
+	}
+
+	if node.Attr.Value != attr {
+		t.Fatalf("Wrong attribute: expected %s, got %s", attr, node.Attr.Value)
+	}
+
+	return node
+}
+
 func checkList(t *testing.T, n Node, nelem int) *ListNode {
 	listNode, ok := n.(*ListNode)
 	if !ok {
@@ -691,3 +984,10 @@ func checkMap(t *testing.T, n Node, nelem int) *MapNode {
 
 	return mapNode
 }
+
+func checkLocation(t *testing.T, n Node, line int, column int) {
+	loc := n.Location()
+	if loc.Line != line || loc.Column != column {
+		t.Fatalf("Wrong location for %T: expected %d:%d, got %s", n, line, column, loc)
+	}
+}
@@ -0,0 +1,293 @@
+package torino
+
+import (
+	"errors"
+	"fmt"
+	"github.com/iafisher/torino/data"
+	"github.com/iafisher/torino/errs"
+	"reflect"
+	"sort"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Convert a Go value to a Torino value.
+func fromGo(value interface{}) (data.TorinoValue, error) {
+	if value == nil {
+		return &data.TorinoNone{}, nil
+	}
+	return fromReflect(reflect.ValueOf(value))
+}
+
+func fromReflect(v reflect.Value) (data.TorinoValue, error) {
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return &data.TorinoNone{}, nil
+		}
+		v = v.Elem()
+	}
+
+	// Torino values are passed through unchanged.
+	if val, ok := v.Interface().(data.TorinoValue); ok {
+		return val, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &data.TorinoInt{int(v.Int())}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := int(v.Uint())
+		if n < 0 || uint64(n) != v.Uint() {
+			return nil, errors.New(fmt.Sprintf("%d is too large for a Torino integer", v.Uint()))
+		}
+		return &data.TorinoInt{n}, nil
+	case reflect.String:
+		return &data.TorinoString{v.String()}, nil
+	case reflect.Bool:
+		return &data.TorinoBool{v.Bool()}, nil
+	case reflect.Slice, reflect.Array:
+		values := []data.TorinoValue{}
+		for i := 0; i < v.Len(); i++ {
+			val, err := fromReflect(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, val)
+		}
+		return &data.TorinoList{values}, nil
+	case reflect.Map:
+		keys := []data.TorinoValue{}
+		values := map[string]data.TorinoValue{}
+		for _, k := range v.MapKeys() {
+			key, err := fromReflect(k)
+			if err != nil {
+				return nil, err
+			}
+
+			val, err := fromReflect(v.MapIndex(k))
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+			values[key.Repr()] = val
+		}
+
+		// Go maps are unordered, so the keys are sorted to make the order of the Torino
+		// map predictable.
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Repr() < keys[j].Repr() })
+		mapVal := data.NewMap()
+		for _, key := range keys {
+			mapVal.Put(key, values[key.Repr()])
+		}
+		return mapVal, nil
+	case reflect.Func:
+		return wrapFunc("function", v)
+	default:
+		return nil, errors.New(fmt.Sprintf("cannot convert Go value of type %s to a Torino value", v.Type()))
+	}
+}
+
+// Convert a Torino value to the Go value that most closely corresponds to it.
+func toGo(val data.TorinoValue) (interface{}, error) {
+	return toGoNested(val, map[data.TorinoValue]bool{})
+}
+
+// Convert a value like toGo. `seen` holds the lists and maps that are being
+// converted, since a list or map that contains itself has no Go equivalent.
+func toGoNested(val data.TorinoValue, seen map[data.TorinoValue]bool) (interface{}, error) {
+	if seen[val] {
+		return nil, errors.New(fmt.Sprintf("cannot convert %s that contains itself to a Go value", val.TypeName()))
+	}
+
+	switch v := val.(type) {
+	case *data.TorinoInt:
+		return v.Value, nil
+	case *data.TorinoString:
+		return v.Value, nil
+	case *data.TorinoBool:
+		return v.Value, nil
+	case *data.TorinoNone:
+		return nil, nil
+	case *data.TorinoList:
+		seen[v] = true
+		defer delete(seen, v)
+
+		values := []interface{}{}
+		for _, elem := range v.Values {
+			converted, err := toGoNested(elem, seen)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, converted)
+		}
+		return values, nil
+	case *data.TorinoMap:
+		seen[v] = true
+		defer delete(seen, v)
+
+		values := map[interface{}]interface{}{}
+		for _, key := range v.Keys {
+			convertedKey, err := toGoNested(key, seen)
+			if err != nil {
+				return nil, err
+			}
+
+			if convertedKey != nil && !reflect.TypeOf(convertedKey).Comparable() {
+				return nil, errors.New(fmt.Sprintf("cannot convert map with %s keys to a Go value", key.TypeName()))
+			}
+
+			converted, err := toGoNested(v.Values[key.Repr()], seen)
+			if err != nil {
+				return nil, err
+			}
+			values[convertedKey] = converted
+		}
+		return values, nil
+	default:
+		return val, nil
+	}
+}
+
+// Convert a Torino value to a Go value of type `t`.
+func toGoType(val data.TorinoValue, t reflect.Type) (reflect.Value, error) {
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		converted, err := toGo(val)
+		if err != nil || converted == nil {
+			return reflect.Zero(t), err
+		}
+		return reflect.ValueOf(converted), nil
+	}
+
+	if reflect.TypeOf(val).AssignableTo(t) {
+		return reflect.ValueOf(val), nil
+	}
+
+	ret := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v, ok := val.(*data.TorinoInt); ok {
+			if ret.OverflowInt(int64(v.Value)) {
+				return ret, errors.New(fmt.Sprintf("%d does not fit in Go %s", v.Value, t))
+			}
+			ret.SetInt(int64(v.Value))
+			return ret, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v, ok := val.(*data.TorinoInt); ok {
+			if v.Value < 0 || ret.OverflowUint(uint64(v.Value)) {
+				return ret, errors.New(fmt.Sprintf("%d does not fit in Go %s", v.Value, t))
+			}
+			ret.SetUint(uint64(v.Value))
+			return ret, nil
+		}
+	case reflect.String:
+		if v, ok := val.(*data.TorinoString); ok {
+			ret.SetString(v.Value)
+			return ret, nil
+		}
+	case reflect.Bool:
+		if v, ok := val.(*data.TorinoBool); ok {
+			ret.SetBool(v.Value)
+			return ret, nil
+		}
+	case reflect.Slice:
+		if v, ok := val.(*data.TorinoList); ok {
+			ret = reflect.MakeSlice(t, len(v.Values), len(v.Values))
+			for i, elem := range v.Values {
+				converted, err := toGoType(elem, t.Elem())
+				if err != nil {
+					return ret, err
+				}
+				ret.Index(i).Set(converted)
+			}
+			return ret, nil
+		}
+	case reflect.Map:
+		if v, ok := val.(*data.TorinoMap); ok {
+			ret = reflect.MakeMapWithSize(t, len(v.Keys))
+			for _, key := range v.Keys {
+				convertedKey, err := toGoType(key, t.Key())
+				if err != nil {
+					return ret, err
+				}
+
+				converted, err := toGoType(v.Values[key.Repr()], t.Elem())
+				if err != nil {
+					return ret, err
+				}
+				ret.SetMapIndex(convertedKey, converted)
+			}
+			return ret, nil
+		}
+	}
+	return ret, errors.New(fmt.Sprintf("cannot convert %s to Go %s", val.TypeName(), t))
+}
+
+// Wrap a Go function in a builtin that converts its arguments and result.
+func wrapFunc(name string, f reflect.Value) (*data.TorinoBuiltin, error) {
+	if f.Kind() != reflect.Func || f.IsNil() {
+		return nil, errors.New(fmt.Sprintf("cannot register %s: not a function", name))
+	}
+
+	t := f.Type()
+	nout := t.NumOut()
+	returnsError := nout > 0 && t.Out(nout-1) == errorType
+	if nout > 2 || (nout == 2 && !returnsError) {
+		return nil, errors.New(fmt.Sprintf(
+			"cannot register %s: a function may return at most a value and an error", name))
+	}
+
+	return &data.TorinoBuiltin{func(args ...data.TorinoValue) (data.TorinoValue, error) {
+		nparams := t.NumIn()
+		if t.IsVariadic() && len(args) < nparams-1 {
+			return nil, errs.NewRuntimeError(errs.CODE_ARGUMENTS, fmt.Sprintf(
+				"wrong number of arguments to %s: expected at least %d, got %d", name, nparams-1, len(args)))
+		} else if !t.IsVariadic() && len(args) != nparams {
+			return nil, errs.NewRuntimeError(errs.CODE_ARGUMENTS, fmt.Sprintf(
+				"wrong number of arguments to %s: expected %d, got %d", name, nparams, len(args)))
+		}
+
+		in := []reflect.Value{}
+		for i, arg := range args {
+			var paramType reflect.Type
+			if t.IsVariadic() && i >= nparams-1 {
+				paramType = t.In(nparams - 1).Elem()
+			} else {
+				paramType = t.In(i)
+			}
+
+			converted, err := toGoType(arg, paramType)
+			if err != nil {
+				return nil, errs.NewRuntimeError(errs.CODE_TYPE, fmt.Sprintf("argument %d of %s: %s", i+1, name, err))
+			}
+			in = append(in, converted)
+		}
+
+		out := f.Call(in)
+		if returnsError {
+			if err := out[len(out)-1]; !err.IsNil() {
+				return nil, hostError(err.Interface().(error))
+			}
+			out = out[:len(out)-1]
+		}
+
+		if len(out) == 0 {
+			return &data.TorinoNone{}, nil
+		}
+
+		val, err := fromReflect(out[0])
+		if err != nil {
+			return nil, errs.NewRuntimeError(errs.CODE_TYPE, fmt.Sprintf("result of %s: %s", name, err))
+		}
+		return val, nil
+	}}, nil
+}
+
+// Convert an error returned by a host function to a Torino runtime error. Runtime
+// errors are passed through, so that host functions can choose the error code.
+func hostError(err error) error {
+	if rerr, ok := err.(*errs.RuntimeError); ok {
+		return rerr
+	}
+	return errs.NewRuntimeError(errs.CODE_RUNTIME, err.Error())
+}
@@ -0,0 +1,153 @@
+/* An API for embedding Torino in Go programs.
+
+Author:  Ian Fisher (iafisher@protonmail.com)
+Version: February 2019
+*/
+package torino
+
+import (
+	"errors"
+	"fmt"
+	"github.com/iafisher/torino/data"
+	"github.com/iafisher/torino/errs"
+	"github.com/iafisher/torino/eval"
+	"github.com/iafisher/torino/vm"
+	"io"
+	"reflect"
+)
+
+// An interpreter runs Torino programs in a global environment that persists between
+// programs, and that the host can add its own functions and values to.
+//
+// Go values passed to the interpreter are converted to Torino values: integers,
+// strings and booleans to the corresponding Torino types, slices and arrays to
+// lists, maps to maps, functions to builtins, and nil to none. Torino values that
+// are returned to the host are converted back in the same way, with lists becoming
+// []interface{} and maps map[interface{}]interface{}. Values that have no Go
+// equivalent, such as functions, are returned as data.TorinoValue.
+type Interpreter struct {
+	env     *vm.Environment
+	machine *vm.VirtualMachine
+}
+
+func NewInterpreter() *Interpreter {
+	return &Interpreter{vm.NewEnv(nil), vm.New()}
+}
+
+// Set the limits on the resources that programs and calls may use.
+func (interp *Interpreter) SetLimits(limits vm.Limits) {
+	interp.machine.SetLimits(limits)
+}
+
+// Set the writer that print and println write to.
+func (interp *Interpreter) SetStdout(w io.Writer) {
+	interp.env.SetStdout(w)
+}
+
+// Set the writer that Run reports errors to.
+func (interp *Interpreter) SetStderr(w io.Writer) {
+	interp.env.SetStderr(w)
+}
+
+// Set the reader that input reads from.
+func (interp *Interpreter) SetStdin(r io.Reader) {
+	interp.env.SetStdin(r)
+}
+
+// Run a program and return its value. Errors in the program are returned as Torino
+// errors, which can be printed with errs.Render.
+func (interp *Interpreter) Eval(text string) (interface{}, error) {
+	code, err := eval.CompileIn(text, interp.env)
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := interp.machine.Execute(code, interp.env)
+	if err != nil {
+		return nil, err
+	}
+	return toGo(val)
+}
+
+// Run a program like Eval, but instead of returning an error, write it to stderr with
+// errs.Render and return false. `path` is the name of the file that the program was
+// read from, or empty if there is none.
+func (interp *Interpreter) Run(text string, path string) (interface{}, bool) {
+	val, err := interp.Eval(text)
+	if err != nil {
+		fmt.Fprint(interp.env.Stderr(), errs.Render(err, text, path))
+		return nil, false
+	}
+	return val, true
+}
+
+// Define a builtin function that calls a Go function. The arguments are converted to
+// the types of the function's parameters, and its result is converted to a Torino
+// value. The function may return nothing, a value, an error, or a value and an error.
+// A non-nil error is raised in the Torino program as a runtime error.
+func (interp *Interpreter) RegisterFunc(name string, f interface{}) error {
+	builtin, err := wrapFunc(name, reflect.ValueOf(f))
+	if err != nil {
+		return err
+	}
+
+	interp.env.Put(name, builtin)
+	return nil
+}
+
+// Define a global variable, converting the Go value to a Torino value.
+func (interp *Interpreter) Set(name string, value interface{}) error {
+	val, err := fromGo(value)
+	if err != nil {
+		return err
+	}
+
+	interp.env.Put(name, val)
+	return nil
+}
+
+// Store the value of a global variable in the Go variable that `ptr` points to,
+// converting it to the variable's type.
+func (interp *Interpreter) Get(name string, ptr interface{}) error {
+	val, ok := interp.env.Get(name)
+	if !ok {
+		return errors.New(fmt.Sprintf("undefined symbol %s", name))
+	}
+
+	dest := reflect.ValueOf(ptr)
+	if dest.Kind() != reflect.Ptr || dest.IsNil() {
+		return errors.New("Get requires a non-nil pointer")
+	}
+
+	converted, err := toGoType(val, dest.Elem().Type())
+	if err != nil {
+		return err
+	}
+
+	dest.Elem().Set(converted)
+	return nil
+}
+
+// Call a global function, such as one that a program defined, with arguments
+// converted from Go values, and return its result.
+func (interp *Interpreter) Call(name string, args ...interface{}) (interface{}, error) {
+	f, ok := interp.env.Get(name)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("undefined symbol %s", name))
+	}
+
+	vals := []data.TorinoValue{}
+	for _, arg := range args {
+		val, err := fromGo(arg)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, val)
+	}
+
+	res, err := interp.machine.Call(f, vals, interp.env)
+	if err != nil {
+		return nil, err
+	}
+	return toGo(res)
+}
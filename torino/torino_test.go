@@ -0,0 +1,260 @@
+package torino
+
+import (
+	"bytes"
+	"errors"
+	"github.com/iafisher/torino/data"
+	"github.com/iafisher/torino/errs"
+	"github.com/iafisher/torino/vm"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRegisterFunc(t *testing.T) {
+	interp := NewInterpreter()
+	checkNoError(t, interp.RegisterFunc("double", func(n int) int { return n * 2 }))
+	checkNoError(t, interp.RegisterFunc("repeat", strings.Repeat))
+	checkNoError(t, interp.RegisterFunc("total", func(ns ...int) int {
+		sum := 0
+		for _, n := range ns {
+			sum += n
+		}
+		return sum
+	}))
+	checkNoError(t, interp.RegisterFunc("lengths", func(words []string) map[string]int {
+		ret := map[string]int{}
+		for _, word := range words {
+			ret[word] = len(word)
+		}
+		return ret
+	}))
+
+	checkEval(t, interp, "double(21)", 42)
+	checkEval(t, interp, "repeat(\"ab\", 3)", "ababab")
+	checkEval(t, interp, "total()", 0)
+	checkEval(t, interp, "total(1, 2, 3)", 6)
+	checkEval(t, interp, "lengths([\"a\", \"abc\"])", map[interface{}]interface{}{"a": 1, "abc": 3})
+	checkEval(t, interp, "let f = double\nf(f(1))", 4)
+}
+
+func TestRegisterFuncErrors(t *testing.T) {
+	interp := NewInterpreter()
+	checkNoError(t, interp.RegisterFunc("double", func(n int) int { return n * 2 }))
+	checkNoError(t, interp.RegisterFunc("byte", func(n uint8) uint8 { return n }))
+	checkNoError(t, interp.RegisterFunc("fail", func() (int, error) { return 0, errors.New("failed") }))
+	checkNoError(t, interp.RegisterFunc("nothing", func() {}))
+
+	checkEval(t, interp, "nothing()", nil)
+	checkEvalError(t, interp, "double(1, 2)", errs.CODE_ARGUMENTS,
+		"wrong number of arguments to double: expected 1, got 2")
+	checkEvalError(t, interp, "double(\"a\")", errs.CODE_TYPE,
+		"argument 1 of double: cannot convert string to Go int")
+	checkEvalError(t, interp, "byte(256)", errs.CODE_TYPE, "argument 1 of byte: 256 does not fit in Go uint8")
+	checkEvalError(t, interp, "fail()", errs.CODE_RUNTIME, "failed")
+
+	err := interp.RegisterFunc("five", 5)
+	if err == nil || err.Error() != "cannot register five: not a function" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+
+	err = interp.RegisterFunc("pair", func() (int, int) { return 1, 2 })
+	if err == nil || err.Error() != "cannot register pair: a function may return at most a value and an error" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestSetAndGet(t *testing.T) {
+	interp := NewInterpreter()
+	checkNoError(t, interp.Set("n", 10))
+	checkNoError(t, interp.Set("names", []string{"a", "b"}))
+	checkNoError(t, interp.Set("ages", map[string]int{"b": 2, "a": 1}))
+	checkNoError(t, interp.Set("nothing", nil))
+
+	checkEval(t, interp, "n * 2", 20)
+	checkEval(t, interp, "names[1]", "b")
+	checkEval(t, interp, "ages", map[interface{}]interface{}{"a": 1, "b": 2})
+	checkEval(t, interp, "nothing", nil)
+
+	// Go maps are converted with their keys in sorted order.
+	checkEval(t, interp, "let keys = []\nfor k in ages {\n\tkeys.append(k)\n}\nkeys", []interface{}{"a", "b"})
+
+	_, err := interp.Eval("let total = n + 1\nlet words = [\"x\", \"y\"]\nlet scores = {\"x\": [1]}")
+	checkNoError(t, err)
+
+	var total int
+	checkNoError(t, interp.Get("total", &total))
+	if total != 11 {
+		t.Fatalf("Wrong value: expected 11, got %d", total)
+	}
+
+	var words []string
+	checkNoError(t, interp.Get("words", &words))
+	if !reflect.DeepEqual(words, []string{"x", "y"}) {
+		t.Fatalf("Wrong value: expected [x y], got %v", words)
+	}
+
+	var scores map[string][]int
+	checkNoError(t, interp.Get("scores", &scores))
+	if !reflect.DeepEqual(scores, map[string][]int{"x": {1}}) {
+		t.Fatalf("Wrong value: expected map[x:[1]], got %v", scores)
+	}
+
+	var raw data.TorinoValue
+	checkNoError(t, interp.Get("words", &raw))
+	if raw.Repr() != "[\"x\", \"y\"]" {
+		t.Fatalf("Wrong value: expected [\"x\", \"y\"], got %s", raw.Repr())
+	}
+
+	err = interp.Get("words", &total)
+	if err == nil || err.Error() != "cannot convert list to Go int" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+
+	err = interp.Get("undefined", &total)
+	if err == nil || err.Error() != "undefined symbol undefined" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestCall(t *testing.T) {
+	interp := NewInterpreter()
+	_, err := interp.Eval("fn add(x, y) {\n\treturn x + y\n}\n\nfn adder(n) {\n\treturn fn(x) { return x + n }\n}")
+	checkNoError(t, err)
+
+	res, err := interp.Call("add", 1, 2)
+	checkNoError(t, err)
+	checkValue(t, res, 3)
+
+	res, err = interp.Call("add", []int{1}, []int{2})
+	checkNoError(t, err)
+	checkValue(t, res, []interface{}{1, 2})
+
+	// Functions that are returned to Go can be passed back to Torino.
+	f, err := interp.Call("adder", 10)
+	checkNoError(t, err)
+	checkNoError(t, interp.Set("add_ten", f))
+	checkEval(t, interp, "add_ten(5)", 15)
+
+	_, err = interp.Call("add", 1)
+	if err == nil || err.Error() != "wrong number of arguments to user-defined function" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+
+	_, err = interp.Call("add", 1, "a")
+	rerr, ok := err.(*errs.RuntimeError)
+	if !ok || rerr.Message() != "unsupported operand types for +: int and string" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+
+	_, err = interp.Eval("let x = [1]\nx.append(x)\nx")
+	if err == nil || err.Error() != "cannot convert list that contains itself to a Go value" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+
+	// The interpreter can be used again after an error.
+	res, err = interp.Call("add", "a", "b")
+	checkNoError(t, err)
+	checkValue(t, res, "ab")
+}
+
+func TestCallFromHostFunction(t *testing.T) {
+	interp := NewInterpreter()
+	interp.SetLimits(vm.Limits{5000, 0, 0})
+	checkNoError(t, interp.RegisterFunc("callback", func(n int) (interface{}, error) {
+		return interp.Call("step", n)
+	}))
+
+	input := `
+fn step(n) {
+	return n + 1
+}
+
+let n = 0
+while n < 100001 {
+	n = callback(n)
+}
+n
+`
+	// The calls from the host function count towards the program's instructions.
+	checkEvalError(t, interp, input, errs.CODE_INSTRUCTION_LIMIT, "maximum instruction count exceeded")
+
+	// Each program gets its own budget.
+	checkEval(t, interp, "callback(callback(1))", 3)
+}
+
+func TestStreams(t *testing.T) {
+	var out bytes.Buffer
+	interp := NewInterpreter()
+	interp.SetStdout(&out)
+	interp.SetStdin(strings.NewReader("world\n"))
+
+	_, err := interp.Eval("println(\"Hello, \" + input(\"Name: \"))")
+	checkNoError(t, err)
+	if out.String() != "Name: Hello, world\n" {
+		t.Fatalf("Wrong output: %q", out.String())
+	}
+}
+
+func TestRun(t *testing.T) {
+	var out, errOut bytes.Buffer
+	interp := NewInterpreter()
+	interp.SetStdout(&out)
+	interp.SetStderr(&errOut)
+
+	val, ok := interp.Run("println(\"a\")\nlet x = 1\nx + \"b\"", "script.tno")
+	if ok || val != nil {
+		t.Fatalf("Expected failure, got %v", val)
+	}
+
+	expected := "script.tno:3:3: RuntimeError [E301]: unsupported operand types for +: int and string\n" +
+		" 3 | x + \"b\"\n" +
+		"   |   ^\n"
+	if errOut.String() != expected {
+		t.Fatalf("Wrong error output: %q", errOut.String())
+	}
+
+	if out.String() != "a\n" {
+		t.Fatalf("Wrong output: %q", out.String())
+	}
+
+	errOut.Reset()
+	val, ok = interp.Run("x + 1", "")
+	if !ok || errOut.String() != "" {
+		t.Fatalf("Unexpected error output: %q", errOut.String())
+	}
+	checkValue(t, val, 2)
+}
+
+func checkEval(t *testing.T, interp *Interpreter, text string, expected interface{}) {
+	val, err := interp.Eval(text)
+	if err != nil {
+		t.Fatalf("Eval error for %q: %s", text, err)
+	}
+	checkValue(t, val, expected)
+}
+
+func checkEvalError(t *testing.T, interp *Interpreter, text string, code string, msg string) {
+	_, err := interp.Eval(text)
+	rerr, ok := err.(*errs.RuntimeError)
+	if !ok {
+		t.Fatalf("Expected runtime error for %q, got %v", text, err)
+	}
+
+	if rerr.Code() != code || rerr.Message() != msg {
+		t.Fatalf("Wrong error for %q: expected %s (%s), got %s (%s)",
+			text, code, msg, rerr.Code(), rerr.Message())
+	}
+}
+
+func checkValue(t *testing.T, val interface{}, expected interface{}) {
+	if !reflect.DeepEqual(val, expected) {
+		t.Fatalf("Wrong value: expected %#v, got %#v", expected, val)
+	}
+}
+
+func checkNoError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
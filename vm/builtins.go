@@ -1,34 +1,93 @@
 package vm
 
 import (
-	"errors"
 	"fmt"
 	"github.com/iafisher/torino/data"
+	"github.com/iafisher/torino/errs"
+	"github.com/iafisher/torino/lexer"
+	"io"
+	"strconv"
+	"strings"
 )
 
-func builtinPrint(vals ...data.TorinoValue) (data.TorinoValue, error) {
+// A builtin function that needs access to the virtual machine, e.g. to call a
+// function that it was passed as an argument.
+type vmBuiltin struct {
+	f func(vm *VirtualMachine, callSite *lexer.Location, args ...data.TorinoValue) (data.TorinoValue, error)
+}
+
+func (t *vmBuiltin) Torino() {}
+
+func (t *vmBuiltin) String() string {
+	return "<built-in function>"
+}
+
+func (t *vmBuiltin) Repr() string {
+	return t.String()
+}
+
+func (t *vmBuiltin) TypeName() string {
+	return "builtin"
+}
+
+// Write a value to the standard output of the environment that the program is
+// running in.
+func builtinPrint(
+	vm *VirtualMachine, callSite *lexer.Location, vals ...data.TorinoValue) (data.TorinoValue, error) {
 	if len(vals) != 1 {
-		return nil, errors.New("print takes one argument")
+		return nil, errs.NewRuntimeError(errs.CODE_ARGUMENTS, "print takes one argument")
 	}
 
-	fmt.Print(vals[0].String())
-	return &data.TorinoNone{}, nil
+	return writeOutput(vm.globals.stdout, vals[0].String())
 }
 
-func builtinPrintln(vals ...data.TorinoValue) (data.TorinoValue, error) {
+func builtinPrintln(
+	vm *VirtualMachine, callSite *lexer.Location, vals ...data.TorinoValue) (data.TorinoValue, error) {
 	if len(vals) != 1 {
-		return nil, errors.New("println takes one argument")
+		return nil, errs.NewRuntimeError(errs.CODE_ARGUMENTS, "println takes one argument")
 	}
 
-	fmt.Println(vals[0].String())
+	return writeOutput(vm.globals.stdout, vals[0].String()+"\n")
+}
+
+func writeOutput(w io.Writer, s string) (data.TorinoValue, error) {
+	_, err := io.WriteString(w, s)
+	if err != nil {
+		return nil, errs.NewRuntimeError(errs.CODE_RUNTIME, fmt.Sprintf("could not write output: %s", err))
+	}
 	return &data.TorinoNone{}, nil
 }
 
+// Read a line from the standard input of the environment that the program is
+// running in, after printing an optional prompt. The line is returned without its
+// line ending, or none is returned at the end of the input.
+func builtinInput(
+	vm *VirtualMachine, callSite *lexer.Location, vals ...data.TorinoValue) (data.TorinoValue, error) {
+	if len(vals) > 1 {
+		return nil, errs.NewRuntimeError(errs.CODE_ARGUMENTS, "input takes at most one argument")
+	}
+
+	if len(vals) == 1 {
+		_, err := writeOutput(vm.globals.stdout, vals[0].String())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	line, err := vm.globals.stdin.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return &data.TorinoNone{}, nil
+	} else if err != nil && err != io.EOF {
+		return nil, errs.NewRuntimeError(errs.CODE_RUNTIME, fmt.Sprintf("could not read input: %s", err))
+	}
+	return &data.TorinoString{strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")}, nil
+}
+
 func builtinRange(vals ...data.TorinoValue) (data.TorinoValue, error) {
 	for _, v := range vals {
 		_, ok := v.(*data.TorinoInt)
 		if !ok {
-			return nil, errors.New("range takes integer arguments")
+			return nil, errs.NewRuntimeError(errs.CODE_TYPE, "range takes integer arguments")
 		}
 	}
 
@@ -46,12 +105,252 @@ func builtinRange(vals ...data.TorinoValue) (data.TorinoValue, error) {
 		hi = vals[1].(*data.TorinoInt).Value
 		step = vals[2].(*data.TorinoInt).Value
 	} else {
-		return nil, errors.New("range takes between one and three arguments")
+		return nil, errs.NewRuntimeError(errs.CODE_ARGUMENTS, "range takes between one and three arguments")
+	}
+
+	if step == 0 {
+		return nil, errs.NewRuntimeError(errs.CODE_VALUE, "range step cannot be zero")
 	}
 
-	lst := []data.TorinoValue{}
-	for i := lo; i < hi; i += step {
-		lst = append(lst, &data.TorinoInt{i})
+	// The range is generated lazily rather than stored as a list.
+	i := lo
+	return data.NewIterator(func() (data.TorinoValue, bool) {
+		if (step > 0 && i >= hi) || (step < 0 && i <= hi) {
+			return nil, false
+		}
+		i += step
+		return &data.TorinoInt{i - step}, true
+	}), nil
+}
+
+// Return a list of the results of calling a function on each element of an iterable.
+func builtinMap(
+	vm *VirtualMachine, callSite *lexer.Location, vals ...data.TorinoValue) (data.TorinoValue, error) {
+	if len(vals) != 2 {
+		return nil, errs.NewRuntimeError(errs.CODE_ARGUMENTS, "map takes two arguments")
+	}
+
+	iterable, ok := vals[1].(data.Iterable)
+	if !ok {
+		return nil, errs.NewRuntimeError(errs.CODE_TYPE, fmt.Sprintf("%s is not iterable", vals[1].TypeName()))
+	}
+
+	results := []data.TorinoValue{}
+	it := iterable.Iter()
+	for val, ok := it.Next(); ok; val, ok = it.Next() {
+		err := vm.tick()
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := vm.callFunction(vals[0], []data.TorinoValue{val}, callSite)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+		if vm.limits.MaxCollectionSize > 0 && len(results) > vm.limits.MaxCollectionSize {
+			return nil, collectionLimitError()
+		}
+	}
+	return &data.TorinoList{results}, nil
+}
+
+// Return the number of elements of a list or map, or of characters of a string.
+func builtinLen(vals ...data.TorinoValue) (data.TorinoValue, error) {
+	if err := data.CheckArgCount("len", vals, 1); err != nil {
+		return nil, err
+	}
+
+	switch v := vals[0].(type) {
+	case *data.TorinoString, *data.TorinoList, *data.TorinoMap:
+		return &data.TorinoInt{collectionSize(v)}, nil
+	default:
+		return nil, errs.NewRuntimeError(errs.CODE_TYPE, fmt.Sprintf("%s has no length", v.TypeName()))
+	}
+}
+
+func builtinStr(vals ...data.TorinoValue) (data.TorinoValue, error) {
+	if err := data.CheckArgCount("str", vals, 1); err != nil {
+		return nil, err
+	}
+	return &data.TorinoString{vals[0].String()}, nil
+}
+
+func builtinRepr(vals ...data.TorinoValue) (data.TorinoValue, error) {
+	if err := data.CheckArgCount("repr", vals, 1); err != nil {
+		return nil, err
+	}
+	return &data.TorinoString{vals[0].Repr()}, nil
+}
+
+// Convert an integer, a boolean or a string in decimal notation to an integer.
+func builtinInt(vals ...data.TorinoValue) (data.TorinoValue, error) {
+	if err := data.CheckArgCount("int", vals, 1); err != nil {
+		return nil, err
+	}
+
+	switch v := vals[0].(type) {
+	case *data.TorinoInt:
+		return v, nil
+	case *data.TorinoBool:
+		if v.Value {
+			return &data.TorinoInt{1}, nil
+		} else {
+			return &data.TorinoInt{0}, nil
+		}
+	case *data.TorinoString:
+		n, err := strconv.Atoi(strings.TrimSpace(v.Value))
+		if err != nil {
+			return nil, errs.NewRuntimeError(errs.CODE_VALUE, fmt.Sprintf("invalid integer %s", v.Repr()))
+		}
+		return &data.TorinoInt{n}, nil
+	default:
+		return nil, errs.NewRuntimeError(errs.CODE_TYPE, fmt.Sprintf("cannot convert %s to int", v.TypeName()))
+	}
+}
+
+// Convert a value to a boolean. Zero, the empty string, empty lists and maps, and
+// none are false.
+func builtinBool(vals ...data.TorinoValue) (data.TorinoValue, error) {
+	if err := data.CheckArgCount("bool", vals, 1); err != nil {
+		return nil, err
+	}
+
+	switch v := vals[0].(type) {
+	case *data.TorinoBool:
+		return v, nil
+	case *data.TorinoInt:
+		return &data.TorinoBool{v.Value != 0}, nil
+	case *data.TorinoString, *data.TorinoList, *data.TorinoMap:
+		return &data.TorinoBool{collectionSize(v) != 0}, nil
+	case *data.TorinoNone:
+		return &data.TorinoBool{false}, nil
+	default:
+		return nil, errs.NewRuntimeError(errs.CODE_TYPE, fmt.Sprintf("cannot convert %s to bool", v.TypeName()))
+	}
+}
+
+// Return the name of a value's type.
+func builtinType(vals ...data.TorinoValue) (data.TorinoValue, error) {
+	if err := data.CheckArgCount("type", vals, 1); err != nil {
+		return nil, err
+	}
+	return &data.TorinoString{vals[0].TypeName()}, nil
+}
+
+func builtinAbs(vals ...data.TorinoValue) (data.TorinoValue, error) {
+	if err := data.CheckArgCount("abs", vals, 1); err != nil {
+		return nil, err
+	}
+
+	n, ok := vals[0].(*data.TorinoInt)
+	if !ok {
+		return nil, errs.NewRuntimeError(errs.CODE_TYPE, "abs takes an integer argument")
+	}
+
+	if n.Value < 0 {
+		return &data.TorinoInt{-n.Value}, nil
+	}
+	return n, nil
+}
+
+func builtinMin(
+	vm *VirtualMachine, callSite *lexer.Location, vals ...data.TorinoValue) (data.TorinoValue, error) {
+	return vm.extreme("min", "<", vals)
+}
+
+func builtinMax(
+	vm *VirtualMachine, callSite *lexer.Location, vals ...data.TorinoValue) (data.TorinoValue, error) {
+	return vm.extreme("max", ">", vals)
+}
+
+// Return the least (for "<") or greatest (for ">") of the arguments or, if there is
+// only one argument, of the elements of the iterable. Integers and strings may be
+// compared, but not with each other.
+func (vm *VirtualMachine) extreme(name string, op string, vals []data.TorinoValue) (data.TorinoValue, error) {
+	if len(vals) == 0 {
+		return nil, errs.NewRuntimeError(errs.CODE_ARGUMENTS, fmt.Sprintf("%s takes at least one argument", name))
+	}
+
+	var ret data.TorinoValue
+	choose := func(val data.TorinoValue) error {
+		if ret == nil {
+			ret = val
+			return nil
+		}
+
+		better, err := binaryCompare(op, val, ret)
+		if err != nil {
+			return err
+		}
+
+		if better.(*data.TorinoBool).Value {
+			ret = val
+		}
+		return nil
+	}
+
+	var err error
+	if len(vals) == 1 {
+		err = vm.forEach(vals[0], choose)
+	} else {
+		for _, val := range vals {
+			err = choose(val)
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ret == nil {
+		return nil, errs.NewRuntimeError(errs.CODE_VALUE, fmt.Sprintf("%s of an empty sequence", name))
+	}
+	return ret, nil
+}
+
+// Return the sum of the integers in an iterable.
+func builtinSum(
+	vm *VirtualMachine, callSite *lexer.Location, vals ...data.TorinoValue) (data.TorinoValue, error) {
+	if err := data.CheckArgCount("sum", vals, 1); err != nil {
+		return nil, err
+	}
+
+	total := 0
+	err := vm.forEach(vals[0], func(elem data.TorinoValue) error {
+		n, ok := elem.(*data.TorinoInt)
+		if !ok {
+			return errs.NewRuntimeError(errs.CODE_TYPE, fmt.Sprintf("cannot sum %s", elem.TypeName()))
+		}
+		total += n.Value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &data.TorinoInt{total}, nil
+}
+
+// Call `f` on each element of an iterable, one at a time, stopping at the first
+// error. Each element counts as a step of execution towards the instruction limit.
+func (vm *VirtualMachine) forEach(val data.TorinoValue, f func(data.TorinoValue) error) error {
+	iterable, ok := val.(data.Iterable)
+	if !ok {
+		return errs.NewRuntimeError(errs.CODE_TYPE, fmt.Sprintf("%s is not iterable", val.TypeName()))
+	}
+
+	it := iterable.Iter()
+	for elem, ok := it.Next(); ok; elem, ok = it.Next() {
+		err := vm.tick()
+		if err == nil {
+			err = f(elem)
+		}
+		if err != nil {
+			return err
+		}
 	}
-	return &data.TorinoList{lst}, nil
+	return nil
 }
@@ -1,18 +1,55 @@
 package vm
 
-import "github.com/iafisher/torino/data"
+import (
+	"bufio"
+	"github.com/iafisher/torino/data"
+	"io"
+	"os"
+)
 
 type Environment struct {
 	symbols   map[string]data.TorinoValue
 	enclosing *Environment
+	// The streams that builtins read from and write to, and that errors are reported
+	// to, which default to the process's standard streams.
+	stdout io.Writer
+	stderr io.Writer
+	stdin  *bufio.Reader
 }
 
+// Create an environment for a program's global variables. If `enclosing` is nil,
+// the environment is enclosed by a new environment that holds the builtins, so that
+// a program may define globals that shadow them.
 func NewEnv(enclosing *Environment) *Environment {
-	env := &Environment{map[string]data.TorinoValue{}, enclosing}
-	env.Put("print", &data.TorinoBuiltin{builtinPrint})
-	env.Put("println", &data.TorinoBuiltin{builtinPrintln})
-	env.Put("range", &data.TorinoBuiltin{builtinRange})
-	return env
+	if enclosing == nil {
+		enclosing = newEnv(nil)
+		enclosing.Put("print", &vmBuiltin{builtinPrint})
+		enclosing.Put("println", &vmBuiltin{builtinPrintln})
+		enclosing.Put("input", &vmBuiltin{builtinInput})
+		enclosing.Put("range", &data.TorinoBuiltin{builtinRange})
+		enclosing.Put("map", &vmBuiltin{builtinMap})
+		enclosing.Put("len", &data.TorinoBuiltin{builtinLen})
+		enclosing.Put("str", &data.TorinoBuiltin{builtinStr})
+		enclosing.Put("repr", &data.TorinoBuiltin{builtinRepr})
+		enclosing.Put("int", &data.TorinoBuiltin{builtinInt})
+		enclosing.Put("bool", &data.TorinoBuiltin{builtinBool})
+		enclosing.Put("type", &data.TorinoBuiltin{builtinType})
+		enclosing.Put("abs", &data.TorinoBuiltin{builtinAbs})
+		enclosing.Put("min", &vmBuiltin{builtinMin})
+		enclosing.Put("max", &vmBuiltin{builtinMax})
+		enclosing.Put("sum", &vmBuiltin{builtinSum})
+	}
+	return newEnv(enclosing)
+}
+
+func newEnv(enclosing *Environment) *Environment {
+	return &Environment{
+		map[string]data.TorinoValue{},
+		enclosing,
+		os.Stdout,
+		os.Stderr,
+		bufio.NewReader(os.Stdin),
+	}
 }
 
 func (env *Environment) Get(k string) (data.TorinoValue, bool) {
@@ -25,6 +62,44 @@ func (env *Environment) Get(k string) (data.TorinoValue, bool) {
 	}
 }
 
+// Report whether `k` is defined in the environment itself, rather than in one that
+// encloses it.
+func (env *Environment) Defines(k string) bool {
+	_, ok := env.symbols[k]
+	return ok
+}
+
 func (env *Environment) Put(k string, v data.TorinoValue) {
 	env.symbols[k] = v
 }
+
+// Return the names of all the symbols defined in the environment and the
+// environments that enclose it.
+func (env *Environment) Names() []string {
+	names := []string{}
+	for k := range env.symbols {
+		names = append(names, k)
+	}
+
+	if env.enclosing != nil {
+		names = append(names, env.enclosing.Names()...)
+	}
+	return names
+}
+
+func (env *Environment) SetStdout(w io.Writer) {
+	env.stdout = w
+}
+
+func (env *Environment) SetStderr(w io.Writer) {
+	env.stderr = w
+}
+
+// Return the writer that errors in the environment's programs should be reported to.
+func (env *Environment) Stderr() io.Writer {
+	return env.stderr
+}
+
+func (env *Environment) SetStdin(r io.Reader) {
+	env.stdin = bufio.NewReader(r)
+}
@@ -0,0 +1,144 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/iafisher/torino/data"
+	"github.com/iafisher/torino/errs"
+	"strings"
+)
+
+func binaryAdd(left data.TorinoValue, right data.TorinoValue) (data.TorinoValue, error) {
+	switch l := left.(type) {
+	case *data.TorinoInt:
+		if r, ok := right.(*data.TorinoInt); ok {
+			return &data.TorinoInt{l.Value + r.Value}, nil
+		}
+	case *data.TorinoString:
+		if r, ok := right.(*data.TorinoString); ok {
+			return &data.TorinoString{l.Value + r.Value}, nil
+		}
+	case *data.TorinoList:
+		if r, ok := right.(*data.TorinoList); ok {
+			values := make([]data.TorinoValue, 0, len(l.Values)+len(r.Values))
+			values = append(values, l.Values...)
+			values = append(values, r.Values...)
+			return &data.TorinoList{values}, nil
+		}
+	}
+	return nil, operandTypeError("+", left, right)
+}
+
+// Multiply integers or repeat a string. A repeated string may not be longer than
+// `maxSize` characters, unless it is zero.
+func binaryMul(left data.TorinoValue, right data.TorinoValue, maxSize int) (data.TorinoValue, error) {
+	switch l := left.(type) {
+	case *data.TorinoInt:
+		switch r := right.(type) {
+		case *data.TorinoInt:
+			return &data.TorinoInt{l.Value * r.Value}, nil
+		case *data.TorinoString:
+			return repeatString(r, l, maxSize)
+		}
+	case *data.TorinoString:
+		if r, ok := right.(*data.TorinoInt); ok {
+			return repeatString(l, r, maxSize)
+		}
+	}
+	return nil, operandTypeError("*", left, right)
+}
+
+// Implement the arithmetic operators that are only defined on integers: -, /, //
+// and %.
+func binaryIntOp(op string, left data.TorinoValue, right data.TorinoValue) (data.TorinoValue, error) {
+	l, ok1 := left.(*data.TorinoInt)
+	r, ok2 := right.(*data.TorinoInt)
+	if !ok1 || !ok2 {
+		return nil, operandTypeError(op, left, right)
+	}
+
+	if op == "-" {
+		return &data.TorinoInt{l.Value - r.Value}, nil
+	}
+
+	if r.Value == 0 {
+		return nil, errs.NewRuntimeError(errs.CODE_DIVISION_BY_ZERO, "division by zero")
+	}
+
+	if op == "/" {
+		return &data.TorinoInt{l.Value / r.Value}, nil
+	} else if op == "//" {
+		return &data.TorinoInt{floorDiv(l.Value, r.Value)}, nil
+	} else {
+		return &data.TorinoInt{l.Value - r.Value*floorDiv(l.Value, r.Value)}, nil
+	}
+}
+
+// Implement the ordering operators, which compare integers numerically and strings
+// lexicographically.
+func binaryCompare(op string, left data.TorinoValue, right data.TorinoValue) (data.TorinoValue, error) {
+	var cmp int
+	switch l := left.(type) {
+	case *data.TorinoInt:
+		r, ok := right.(*data.TorinoInt)
+		if !ok {
+			return nil, operandTypeError(op, left, right)
+		}
+
+		if l.Value < r.Value {
+			cmp = -1
+		} else if l.Value > r.Value {
+			cmp = 1
+		}
+	case *data.TorinoString:
+		r, ok := right.(*data.TorinoString)
+		if !ok {
+			return nil, operandTypeError(op, left, right)
+		}
+
+		cmp = strings.Compare(l.Value, r.Value)
+	default:
+		return nil, operandTypeError(op, left, right)
+	}
+
+	if op == "<" {
+		return &data.TorinoBool{cmp < 0}, nil
+	} else if op == "<=" {
+		return &data.TorinoBool{cmp <= 0}, nil
+	} else if op == ">" {
+		return &data.TorinoBool{cmp > 0}, nil
+	} else {
+		return &data.TorinoBool{cmp >= 0}, nil
+	}
+}
+
+func repeatString(s *data.TorinoString, n *data.TorinoInt, maxSize int) (data.TorinoValue, error) {
+	if n.Value <= 0 || len(s.Value) == 0 {
+		return &data.TorinoString{""}, nil
+	}
+
+	// The size is checked before the string is built, since it could be arbitrarily
+	// large, or too large to represent at all.
+	if maxSize > 0 && s.Len() > maxSize/n.Value {
+		return nil, collectionLimitError()
+	}
+
+	if n.Value > MAX_REPEATED_STRING_LENGTH/len(s.Value) {
+		return nil, errs.NewRuntimeError(errs.CODE_VALUE, "repeated string is too long")
+	}
+	return &data.TorinoString{strings.Repeat(s.Value, n.Value)}, nil
+}
+
+func operandTypeError(op string, left data.TorinoValue, right data.TorinoValue) error {
+	return errs.NewRuntimeError(errs.CODE_TYPE, fmt.Sprintf("unsupported operand types for %s: %s and %s",
+		op, left.TypeName(), right.TypeName()))
+}
+
+// Integer division that rounds towards negative infinity, unlike Go's / operator
+// which truncates towards zero.
+func floorDiv(x, y int) int {
+	q := x / y
+	if (x%y != 0) && ((x < 0) != (y < 0)) {
+		q -= 1
+	}
+	return q
+}
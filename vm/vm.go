@@ -6,274 +6,784 @@ Version: February 2019
 package vm
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"github.com/iafisher/torino/compiler"
 	"github.com/iafisher/torino/data"
+	"github.com/iafisher/torino/errs"
+	"github.com/iafisher/torino/lexer"
+	"strings"
 )
 
+// The default maximum number of nested calls to user-defined functions.
+const DEFAULT_RECURSION_LIMIT = 1000
+
+// How many instructions are executed between checks of whether the context has been
+// cancelled.
+const CONTEXT_CHECK_INTERVAL = 1024
+
+// The longest string, in bytes, that string repetition may create, even if there is
+// no limit on collection size, so that a single repetition cannot exhaust the host's
+// memory.
+const MAX_REPEATED_STRING_LENGTH = 1 << 30
+
+// Limits on the resources that a program may use, so that a host can run untrusted
+// code. A limit of zero means that there is no limit.
+type Limits struct {
+	// The maximum number of instructions executed by a single call to Execute.
+	MaxInstructions int
+	// The maximum number of values on the value stack, including local variables.
+	MaxStackDepth int
+	// The maximum number of elements of a list or map, or of characters of a string,
+	// created by the program.
+	MaxCollectionSize int
+}
+
+// The virtual machine executes code objects on a single value stack. Each call to a
+// user-defined function pushes a frame onto the frame stack, whose local variables
+// occupy the slots of the value stack starting at the frame's base pointer, followed
+// by the values that the function's instructions push and pop. Calls and returns
+// switch between frames within a single dispatch loop, rather than recursing in Go.
 type VirtualMachine struct {
 	stack []data.TorinoValue
+	// The global variables of the program being executed.
+	globals *Environment
+	// The active frames, innermost last. The outermost frame is the program's.
+	frames []*callFrame
+	// The number of active frames that are programs' rather than functions'.
+	programs int
+	// The maximum number of frames of user-defined functions.
+	recursionLimit int
+	limits         Limits
+	// The number of instructions executed so far by the current call to Execute.
+	instructions int
+	// The context of the current call to Execute, and its done channel, which is nil
+	// if the context can never be cancelled.
+	ctx  context.Context
+	done <-chan struct{}
+}
+
+// The execution state of the program or of a call to a user-defined function.
+type callFrame struct {
+	// The name of the function, for tracebacks.
+	name string
+	code *compiler.TorinoCode
+	// The offset of the next instruction to execute.
+	pc int
+	// The index in the value stack of the frame's first local variable. Everything
+	// from the base pointer up belongs to the frame, and is discarded when it
+	// returns.
+	base     int
+	upvalues []*compiler.TorinoCell
+	// The location of the call that created the frame, or nil for the program.
+	callSite *lexer.Location
 }
 
 func New() *VirtualMachine {
-	return &VirtualMachine{}
+	return &VirtualMachine{nil, nil, nil, 0, DEFAULT_RECURSION_LIMIT, Limits{}, 0, nil, nil}
 }
 
+// Set the maximum number of nested calls to user-defined functions. Exceeding it
+// raises a runtime error.
+func (vm *VirtualMachine) SetRecursionLimit(limit int) {
+	vm.recursionLimit = limit
+}
+
+// Set the limits on the resources that programs may use. Exceeding a limit raises a
+// runtime error whose kind and code identify the limit.
+func (vm *VirtualMachine) SetLimits(limits Limits) {
+	vm.limits = limits
+}
+
+// Execute a top-level program. Its global variables are stored in `env`.
 func (vm *VirtualMachine) Execute(
-	program []*compiler.Instruction, env *Environment) (data.TorinoValue, error) {
-	/* Print the bytecode, for debugging.
-	for _, inst := range program {
-		fmt.Printf("%v\n", inst)
+	code *compiler.TorinoCode, env *Environment) (data.TorinoValue, error) {
+	return vm.ExecuteContext(context.Background(), code, env)
+}
+
+// Execute a top-level program, stopping with an error if `ctx` is cancelled or its
+// deadline passes. The context is checked periodically rather than before every
+// instruction, so execution may continue briefly after it is cancelled.
+func (vm *VirtualMachine) ExecuteContext(
+	ctx context.Context, code *compiler.TorinoCode, env *Environment) (data.TorinoValue, error) {
+	if ctx.Err() != nil {
+		return nil, cancelledError(ctx)
 	}
-	fmt.Println("DONE")
-	*/
 
-	pc := 0
-	for pc < len(program) {
-		inst := program[pc]
-		jump, err := vm.executeOne(inst, env)
-		if err != nil {
-			return nil, err
+	defer vm.begin(ctx, env)()
+	vm.programs += 1
+	defer func() { vm.programs -= 1 }()
+	vm.frames = append(vm.frames, &callFrame{"<program>", code, 0, len(vm.stack), nil, nil})
+	vm.stack = append(vm.stack, make([]data.TorinoValue, len(code.LocalNames))...)
+	return vm.run()
+}
+
+// Call a function value, such as a user-defined function that a program defined in
+// `env`, from Go. The limits apply to the call as they would to a program.
+func (vm *VirtualMachine) Call(
+	f data.TorinoValue, args []data.TorinoValue, env *Environment) (data.TorinoValue, error) {
+	defer vm.begin(context.Background(), env)()
+	return vm.callFunction(f, args, nil)
+}
+
+// Prepare to execute code whose global variables are stored in `env`, and return a
+// function that restores the previous globals once it has finished. If the virtual
+// machine is already executing code, e.g. because a host function called back into
+// it, the instruction count and the context of the outermost execution still apply,
+// so that the callback cannot escape them.
+func (vm *VirtualMachine) begin(ctx context.Context, env *Environment) func() {
+	if len(vm.frames) == 0 {
+		vm.ctx = ctx
+		vm.done = ctx.Done()
+		vm.instructions = 0
+	}
+
+	globals := vm.globals
+	vm.globals = env
+	return func() { vm.globals = globals }
+}
+
+// Run the innermost frame until it returns, along with any frames that it calls,
+// and return its return value. When the program runs off the end of its code, its
+// return value is the value left on top of the stack, if any.
+func (vm *VirtualMachine) run() (data.TorinoValue, error) {
+	entry := len(vm.frames) - 1
+	for {
+		frame := vm.frames[len(vm.frames)-1]
+		code := frame.code
+
+		var op compiler.Opcode
+		if frame.pc < len(code.Code) {
+			op = compiler.Opcode(code.Code[frame.pc])
+		} else {
+			op = compiler.RETURN_VALUE
+			if len(vm.stack) == frame.base+len(code.LocalNames) {
+				vm.pushStack(&data.TorinoNone{})
+			}
 		}
 
-		if inst.Name == "RETURN_VALUE" {
-			break
+		if op == compiler.RETURN_VALUE {
+			val := vm.popStack()
+			vm.stack = vm.stack[:frame.base]
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			if len(vm.frames) == entry {
+				return val, nil
+			}
+			vm.pushStack(val)
+			continue
+		}
+
+		err := vm.checkLimits()
+		jump := 0
+		if err == nil {
+			jump, err = vm.executeOne(frame)
+		}
+		if err != nil {
+			rerr, ok := err.(*errs.RuntimeError)
+			if !ok {
+				rerr = errs.NewRuntimeError(errs.CODE_RUNTIME, err.Error())
+			}
+			// Errors from functions called by builtins have already been located.
+			if rerr.Location() == nil {
+				rerr.SetLocation(code.Locs[frame.pc])
+				rerr.Traceback = vm.traceback(code.Locs[frame.pc])
+			}
+
+			// Unwind all the frames that this call of run was responsible for.
+			vm.stack = vm.stack[:vm.frames[entry].base]
+			vm.frames = vm.frames[:entry]
+			return nil, rerr
 		}
 
-		pc += jump
+		// If the instruction was a call, the new frame is now the innermost, and the
+		// caller resumes after the call once the new frame returns.
+		frame.pc += jump
 	}
+}
 
-	if len(vm.stack) > 0 {
-		return vm.stack[len(vm.stack)-1], nil
-	} else {
-		return &data.TorinoNone{}, nil
+// Check the limits on the program's execution before the next instruction is
+// executed.
+func (vm *VirtualMachine) checkLimits() error {
+	if vm.limits.MaxStackDepth > 0 && len(vm.stack) > vm.limits.MaxStackDepth {
+		return errs.NewLimitError(errs.CODE_STACK_LIMIT, "maximum stack depth exceeded")
 	}
+	return vm.tick()
 }
 
-func (vm *VirtualMachine) executeOne(inst *compiler.Instruction, env *Environment) (int, error) {
-	if inst.Name == "PUSH_CONST" {
-		vm.pushStack(inst.Args[0])
-	} else if inst.Name == "STORE_NAME" {
-		key := inst.Args[0].(*data.TorinoString).Value
-		_, ok := env.Get(key)
-		if ok {
-			return 0, errors.New(fmt.Sprintf("cannot redefine symbol %s", key))
+// Count one step of execution against the instruction limit, and periodically check
+// whether the context has been cancelled. Each instruction is a step, and so is each
+// iteration of a loop that an instruction or builtin runs in Go, so that a single
+// instruction cannot run for arbitrarily long.
+func (vm *VirtualMachine) tick() error {
+	vm.instructions += 1
+	if vm.limits.MaxInstructions > 0 && vm.instructions > vm.limits.MaxInstructions {
+		return errs.NewLimitError(errs.CODE_INSTRUCTION_LIMIT, "maximum instruction count exceeded")
+	}
+
+	if vm.done != nil && vm.instructions%CONTEXT_CHECK_INTERVAL == 0 {
+		select {
+		case <-vm.done:
+			return cancelledError(vm.ctx)
+		default:
 		}
-		env.Put(key, vm.popStack())
-		vm.pushStack(&data.TorinoNone{})
-	} else if inst.Name == "ASSIGN_NAME" {
-		key := inst.Args[0].(*data.TorinoString).Value
-		_, ok := env.Get(key)
-		if !ok {
-			return 0, errors.New(fmt.Sprintf("undefined symbol %s", key))
+	}
+	return nil
+}
+
+func cancelledError(ctx context.Context) error {
+	return errs.NewLimitError(errs.CODE_CANCELLED, fmt.Sprintf("execution cancelled: %s", ctx.Err()))
+}
+
+// Return an error if any of the values is a collection larger than the limit on
+// collection size.
+func (vm *VirtualMachine) checkSize(vals ...data.TorinoValue) error {
+	if vm.limits.MaxCollectionSize <= 0 {
+		return nil
+	}
+
+	for _, val := range vals {
+		if collectionSize(val) > vm.limits.MaxCollectionSize {
+			return collectionLimitError()
 		}
-		env.Put(key, vm.popStack())
-		vm.pushStack(&data.TorinoNone{})
-	} else if inst.Name == "PUSH_NAME" {
-		key := inst.Args[0].(*data.TorinoString).Value
-		val, ok := env.Get(key)
-		if !ok {
-			return 0, errors.New(fmt.Sprintf("undefined symbol %s", key))
+	}
+	return nil
+}
+
+// Return the number of elements of a list or map, or of characters of a string, or
+// zero for any other value.
+func collectionSize(val data.TorinoValue) int {
+	switch v := val.(type) {
+	case *data.TorinoString:
+		return v.Len()
+	case *data.TorinoList:
+		return len(v.Values)
+	case *data.TorinoMap:
+		return len(v.Keys)
+	default:
+		return 0
+	}
+}
+
+func collectionLimitError() error {
+	return errs.NewLimitError(errs.CODE_COLLECTION_LIMIT, "maximum collection size exceeded")
+}
+
+// Return the traceback for an error raised at `loc` in the innermost frame.
+func (vm *VirtualMachine) traceback(loc *lexer.Location) []errs.Frame {
+	frames := []errs.Frame{}
+	for i, frame := range vm.frames {
+		if i+1 < len(vm.frames) {
+			frames = append(frames, errs.Frame{frame.name, vm.frames[i+1].callSite})
+		} else {
+			frames = append(frames, errs.Frame{frame.name, loc})
+		}
+	}
+	return frames
+}
+
+// Execute the next instruction of a frame and return the offset of the instruction
+// to execute after it, relative to the frame's current offset.
+func (vm *VirtualMachine) executeOne(frame *callFrame) (int, error) {
+	code := frame.code
+	pc := frame.pc
+	// The frame's local variables, which are only valid until the stack grows.
+	locals := vm.stack[frame.base : frame.base+len(code.LocalNames)]
+	upvalues := frame.upvalues
+	op := compiler.Opcode(code.Code[pc])
+	switch op {
+	case compiler.PUSH_CONST:
+		vm.pushStack(code.Constants[code.Code[pc+1]])
+	case compiler.LOAD_LOCAL:
+		slot := code.Code[pc+1]
+		val := locals[slot]
+		if val == nil {
+			return 0, errs.NewRuntimeError(errs.CODE_NAME, fmt.Sprintf("undefined symbol %s", code.LocalNames[slot]))
 		}
 		vm.pushStack(val)
-	} else if inst.Name == "BINARY_ADD" {
-		left, right, ok := vm.popTwoInts()
+	case compiler.STORE_LOCAL:
+		locals[code.Code[pc+1]] = vm.popStack()
+	case compiler.LOAD_CELL:
+		slot := code.Code[pc+1]
+		cell, ok := locals[slot].(*compiler.TorinoCell)
 		if !ok {
-			return 0, errors.New("+ takes integer operands")
+			return 0, errs.NewRuntimeError(errs.CODE_NAME, fmt.Sprintf("undefined symbol %s", code.LocalNames[slot]))
 		}
-		vm.pushStack(&data.TorinoInt{left.Value + right.Value})
-	} else if inst.Name == "BINARY_SUB" {
-		left, right, ok := vm.popTwoInts()
+		vm.pushStack(cell.Value)
+	case compiler.STORE_CELL:
+		slot := code.Code[pc+1]
+		cell, ok := locals[slot].(*compiler.TorinoCell)
 		if !ok {
-			return 0, errors.New("- takes integer operands")
+			return 0, errs.NewRuntimeError(errs.CODE_NAME, fmt.Sprintf("undefined symbol %s", code.LocalNames[slot]))
 		}
-		vm.pushStack(&data.TorinoInt{left.Value - right.Value})
-	} else if inst.Name == "BINARY_MUL" {
-		left, right, ok := vm.popTwoInts()
-		if !ok {
-			return 0, errors.New("* takes integer operands")
+		cell.Value = vm.popStack()
+	case compiler.DEFINE_CELL:
+		locals[code.Code[pc+1]] = &compiler.TorinoCell{vm.popStack()}
+	case compiler.LOAD_UPVALUE:
+		vm.pushStack(upvalues[code.Code[pc+1]].Value)
+	case compiler.STORE_UPVALUE:
+		upvalues[code.Code[pc+1]].Value = vm.popStack()
+	case compiler.MAKE_CLOSURE:
+		f := code.Constants[code.Code[pc+1]].(*compiler.TorinoFunction)
+		cells := make([]*compiler.TorinoCell, len(f.Body.Upvalues))
+		for i, upvalue := range f.Body.Upvalues {
+			if upvalue.IsLocal {
+				cell, ok := locals[upvalue.Index].(*compiler.TorinoCell)
+				if !ok {
+					return 0, errs.NewRuntimeError(errs.CODE_NAME, fmt.Sprintf("undefined symbol %s", upvalue.Name))
+				}
+				cells[i] = cell
+			} else {
+				cells[i] = upvalues[upvalue.Index]
+			}
 		}
-		vm.pushStack(&data.TorinoInt{left.Value * right.Value})
-	} else if inst.Name == "BINARY_DIV" {
-		left, right, ok := vm.popTwoInts()
-		if !ok {
-			return 0, errors.New("/ takes integer operands")
+		vm.pushStack(&compiler.TorinoClosure{f, cells})
+	case compiler.DEFINE_GLOBAL:
+		key := code.Names[code.Code[pc+1]]
+		if vm.globals.Defines(key) {
+			return 0, errs.NewRuntimeError(errs.CODE_NAME, fmt.Sprintf("cannot redefine symbol %s", key))
 		}
-		vm.pushStack(&data.TorinoInt{left.Value / right.Value})
-	} else if inst.Name == "BINARY_EQ" {
-		left, right, ok := vm.popTwoInts()
+		vm.globals.Put(key, vm.popStack())
+	case compiler.STORE_GLOBAL:
+		key := code.Names[code.Code[pc+1]]
+		_, ok := vm.globals.Get(key)
 		if !ok {
-			return 0, errors.New("== takes integer operands")
+			return 0, errs.NewRuntimeError(errs.CODE_NAME, fmt.Sprintf("undefined symbol %s", key))
 		}
-		vm.pushStack(&data.TorinoBool{left.Value == right.Value})
-	} else if inst.Name == "BINARY_GT" {
-		left, right, ok := vm.popTwoInts()
+		vm.globals.Put(key, vm.popStack())
+	case compiler.LOAD_GLOBAL:
+		key := code.Names[code.Code[pc+1]]
+		val, ok := vm.globals.Get(key)
 		if !ok {
-			return 0, errors.New("> takes integer operands")
+			return 0, errs.NewRuntimeError(errs.CODE_NAME, fmt.Sprintf("undefined symbol %s", key))
 		}
-		vm.pushStack(&data.TorinoBool{left.Value > right.Value})
-	} else if inst.Name == "BINARY_LT" {
-		left, right, ok := vm.popTwoInts()
-		if !ok {
-			return 0, errors.New("< takes integer operands")
+		vm.pushStack(val)
+	case compiler.BINARY_ADD:
+		left, right := vm.popTwo()
+		res, err := binaryAdd(left, right)
+		if err == nil {
+			err = vm.checkSize(res)
 		}
-		vm.pushStack(&data.TorinoBool{left.Value < right.Value})
-	} else if inst.Name == "BINARY_GE" {
-		left, right, ok := vm.popTwoInts()
-		if !ok {
-			return 0, errors.New(">= takes integer operands")
+		if err != nil {
+			return 0, err
 		}
-		vm.pushStack(&data.TorinoBool{left.Value >= right.Value})
-	} else if inst.Name == "BINARY_LE" {
-		left, right, ok := vm.popTwoInts()
-		if !ok {
-			return 0, errors.New("<= takes integer operands")
+		vm.pushStack(res)
+	case compiler.BINARY_SUB:
+		left, right := vm.popTwo()
+		res, err := binaryIntOp("-", left, right)
+		if err != nil {
+			return 0, err
 		}
-		vm.pushStack(&data.TorinoBool{left.Value <= right.Value})
-	} else if inst.Name == "BINARY_AND" {
-		left, right, ok := vm.popTwoBools()
-		if !ok {
-			return 0, errors.New("and takes boolean operands")
+		vm.pushStack(res)
+	case compiler.BINARY_MUL:
+		left, right := vm.popTwo()
+		res, err := binaryMul(left, right, vm.limits.MaxCollectionSize)
+		if err != nil {
+			return 0, err
 		}
-		vm.pushStack(&data.TorinoBool{left.Value && right.Value})
-	} else if inst.Name == "BINARY_OR" {
-		left, right, ok := vm.popTwoBools()
-		if !ok {
-			return 0, errors.New("or takes boolean operands")
+		vm.pushStack(res)
+	case compiler.BINARY_DIV:
+		left, right := vm.popTwo()
+		res, err := binaryIntOp("/", left, right)
+		if err != nil {
+			return 0, err
 		}
-		vm.pushStack(&data.TorinoBool{left.Value || right.Value})
-	} else if inst.Name == "BINARY_INDEX" {
+		vm.pushStack(res)
+	case compiler.BINARY_FLOOR_DIV:
+		left, right := vm.popTwo()
+		res, err := binaryIntOp("//", left, right)
+		if err != nil {
+			return 0, err
+		}
+		vm.pushStack(res)
+	case compiler.BINARY_MOD:
+		left, right := vm.popTwo()
+		res, err := binaryIntOp("%", left, right)
+		if err != nil {
+			return 0, err
+		}
+		vm.pushStack(res)
+	case compiler.BINARY_EQ:
+		left, right := vm.popTwo()
+		vm.pushStack(&data.TorinoBool{data.Equal(left, right)})
+	case compiler.BINARY_NE:
+		left, right := vm.popTwo()
+		vm.pushStack(&data.TorinoBool{!data.Equal(left, right)})
+	case compiler.BINARY_GT:
+		left, right := vm.popTwo()
+		res, err := binaryCompare(">", left, right)
+		if err != nil {
+			return 0, err
+		}
+		vm.pushStack(res)
+	case compiler.BINARY_LT:
+		left, right := vm.popTwo()
+		res, err := binaryCompare("<", left, right)
+		if err != nil {
+			return 0, err
+		}
+		vm.pushStack(res)
+	case compiler.BINARY_GE:
+		left, right := vm.popTwo()
+		res, err := binaryCompare(">=", left, right)
+		if err != nil {
+			return 0, err
+		}
+		vm.pushStack(res)
+	case compiler.BINARY_LE:
+		left, right := vm.popTwo()
+		res, err := binaryCompare("<=", left, right)
+		if err != nil {
+			return 0, err
+		}
+		vm.pushStack(res)
+	case compiler.BINARY_IN:
+		item := vm.popStack()
+		switch container := vm.popStack().(type) {
+		case *data.TorinoList:
+			found := false
+			for _, val := range container.Values {
+				if data.Equal(val, item) {
+					found = true
+					break
+				}
+			}
+			vm.pushStack(&data.TorinoBool{found})
+		case *data.TorinoMap:
+			_, ok := container.Get(item)
+			vm.pushStack(&data.TorinoBool{ok})
+		case *data.TorinoString:
+			sub, ok := item.(*data.TorinoString)
+			if !ok {
+				return 0, errs.NewRuntimeError(errs.CODE_TYPE, "left operand of in must be a string when right operand is a string")
+			}
+			vm.pushStack(&data.TorinoBool{strings.Contains(container.Value, sub.Value)})
+		case *data.TorinoIterator:
+			found := false
+			for val, ok := container.Next(); ok; val, ok = container.Next() {
+				err := vm.tick()
+				if err != nil {
+					return 0, err
+				}
+
+				if data.Equal(val, item) {
+					found = true
+					break
+				}
+			}
+			vm.pushStack(&data.TorinoBool{found})
+		default:
+			return 0, errs.NewRuntimeError(errs.CODE_TYPE, "right operand of in must be a list, map, string or iterator")
+		}
+	case compiler.BINARY_INDEX:
 		switch indexed := vm.popStack().(type) {
 		case *data.TorinoList:
 			index, ok := vm.popStack().(*data.TorinoInt)
 			if !ok {
-				return 0, errors.New("index must be an integer")
+				return 0, errs.NewRuntimeError(errs.CODE_TYPE, "index must be an integer")
 			}
 
 			if index.Value < 0 || index.Value >= len(indexed.Values) {
-				return 0, errors.New("index out of bounds")
+				return 0, errs.NewRuntimeError(errs.CODE_INDEX, "index out of bounds")
 			}
 			vm.pushStack(indexed.Values[index.Value])
 		case *data.TorinoMap:
 			index := vm.popStack()
 			val, ok := indexed.Get(index)
 			if !ok {
-				return 0, errors.New("key not in map")
+				return 0, errs.NewRuntimeError(errs.CODE_INDEX, "key not in map")
 			}
 
 			vm.pushStack(val)
 		case *data.TorinoString:
 			index, ok := vm.popStack().(*data.TorinoInt)
 			if !ok {
-				return 0, errors.New("index must be an integer")
+				return 0, errs.NewRuntimeError(errs.CODE_TYPE, "index must be an integer")
 			}
 
-			if index.Value < 0 || index.Value >= len(indexed.Value) {
-				return 0, errors.New("index out of bounds")
+			char, ok := indexed.Char(index.Value)
+			if !ok {
+				return 0, errs.NewRuntimeError(errs.CODE_INDEX, "index out of bounds")
+			}
+			vm.pushStack(char)
+		default:
+			return 0, errs.NewRuntimeError(errs.CODE_TYPE, "only lists and maps may be indexed")
+		}
+	case compiler.STORE_INDEX:
+		val := vm.popStack()
+		switch indexed := vm.popStack().(type) {
+		case *data.TorinoList:
+			index, ok := vm.popStack().(*data.TorinoInt)
+			if !ok {
+				return 0, errs.NewRuntimeError(errs.CODE_TYPE, "index must be an integer")
 			}
 
-			vm.pushStack(&data.TorinoString{string(indexed.Value[index.Value])})
+			if index.Value < 0 || index.Value >= len(indexed.Values) {
+				return 0, errs.NewRuntimeError(errs.CODE_INDEX, "index out of bounds")
+			}
+			indexed.Values[index.Value] = val
+		case *data.TorinoMap:
+			indexed.Put(vm.popStack(), val)
+			err := vm.checkSize(indexed)
+			if err != nil {
+				return 0, err
+			}
+		case *data.TorinoString:
+			return 0, errs.NewRuntimeError(errs.CODE_TYPE, "strings are immutable")
 		default:
-			return 0, errors.New("only lists and maps may be indexed")
+			return 0, errs.NewRuntimeError(errs.CODE_TYPE, "only lists and maps support index assignment")
 		}
-	} else if inst.Name == "UNARY_MINUS" {
+	case compiler.UNARY_MINUS:
 		arg, ok := vm.popStack().(*data.TorinoInt)
 		if !ok {
-			return 0, errors.New("unary - takes integer operand")
+			return 0, errs.NewRuntimeError(errs.CODE_TYPE, "unary - takes integer operand")
 		}
 
 		vm.pushStack(&data.TorinoInt{-arg.Value})
-	} else if inst.Name == "CALL_FUNCTION" {
+	case compiler.UNARY_NOT:
+		arg, ok := vm.popStack().(*data.TorinoBool)
+		if !ok {
+			return 0, errs.NewRuntimeError(errs.CODE_TYPE, "not takes boolean operand")
+		}
+
+		vm.pushStack(&data.TorinoBool{!arg.Value})
+	case compiler.CALL_FUNCTION:
 		// Get the function itself.
 		tos := vm.popStack()
 
-		// Gather the arguments for the function.
-		args := []data.TorinoValue{}
-		for i := 0; i < inst.Args[0].(*data.TorinoInt).Value; i++ {
-			args = append(args, vm.popStack())
-		}
-
-		builtin, ok := tos.(*data.TorinoBuiltin)
-		if ok {
-			res, err := builtin.F(args...)
+		if closure, ok := tos.(*compiler.TorinoClosure); ok {
+			// The arguments are left on the stack, where they become the first local
+			// variables of the new frame.
+			err := vm.pushFrame(closure, int(code.Code[pc+1]), code.Locs[pc])
 			if err != nil {
 				return 0, err
 			}
-			vm.pushStack(res)
-		} else {
-			f, ok := tos.(*compiler.TorinoFunction)
-			if !ok {
-				return 0, errors.New("cannot apply non-function")
-			}
+			break
+		}
 
-			fEnv := NewEnv(env)
+		// Gather the arguments for the function.
+		args := vm.popArgs(int(code.Code[pc+1]))
 
-			if len(args) != len(f.Params) {
-				return 0, errors.New("wrong number of arguments to user-defined function")
-			}
+		res, err := vm.callFunction(tos, args, code.Locs[pc])
+		if err == nil {
+			err = vm.checkSize(res)
+		}
+		if err != nil {
+			return 0, err
+		}
+		vm.pushStack(res)
+	case compiler.CALL_METHOD:
+		name := code.Names[code.Code[pc+1]]
+		self := vm.popStack()
+		args := vm.popArgs(int(code.Code[pc+2]))
 
-			for i, param := range f.Params {
-				fEnv.Put(param.Value, args[i])
-			}
+		method, ok := data.LookupMethod(self, name)
+		if !ok {
+			return 0, errs.NewRuntimeError(errs.CODE_NAME, fmt.Sprintf("%s has no method %s", self.TypeName(), name))
+		}
 
-			val, err := vm.Execute(f.Body, fEnv)
-			if err != nil {
-				return 0, err
-			}
-			vm.pushStack(val)
+		// Methods such as append grow their receiver, so it is checked as well as the
+		// result.
+		res, err := method(self, args...)
+		if err == nil {
+			err = vm.checkSize(self, res)
+		}
+		if err != nil {
+			return 0, err
+		}
+		vm.pushStack(res)
+	case compiler.LOAD_ATTR:
+		name := code.Names[code.Code[pc+1]]
+		self := vm.popStack()
+
+		method, ok := data.LookupMethod(self, name)
+		if !ok {
+			return 0, errs.NewRuntimeError(errs.CODE_NAME, fmt.Sprintf("%s has no method %s", self.TypeName(), name))
 		}
-		// The following operations don't affect the stack.
-	} else if inst.Name == "MAKE_LIST" {
-		nelems := inst.Args[0].(*data.TorinoInt).Value
+
+		// Bind the method to its receiver so that it can be called later like any
+		// other function.
+		vm.pushStack(&data.TorinoBuiltin{func(args ...data.TorinoValue) (data.TorinoValue, error) {
+			res, err := method(self, args...)
+			if err == nil {
+				err = vm.checkSize(self, res)
+			}
+			return res, err
+		}})
+	case compiler.MAKE_LIST:
+		nelems := int(code.Code[pc+1])
 
 		values := []data.TorinoValue{}
 		for i := 0; i < nelems; i++ {
 			values = append(values, vm.popStack())
 		}
-		vm.pushStack(&data.TorinoList{values})
-	} else if inst.Name == "MAKE_MAP" {
-		nelems := inst.Args[0].(*data.TorinoInt).Value
+		list := &data.TorinoList{values}
+		err := vm.checkSize(list)
+		if err != nil {
+			return 0, err
+		}
+		vm.pushStack(list)
+	case compiler.MAKE_MAP:
+		nelems := int(code.Code[pc+1])
 
-		mapVal := &data.TorinoMap{map[string]data.TorinoValue{}}
+		// Insert the pairs in the order they were pushed, so that the map's keys are
+		// ordered as they were in the source code.
+		items := vm.stack[len(vm.stack)-2*nelems:]
+		mapVal := data.NewMap()
 		for i := 0; i < nelems; i++ {
-			val := vm.popStack()
-			key := vm.popStack()
-			mapVal.Put(key, val)
+			mapVal.Put(items[2*i], items[2*i+1])
+		}
+		vm.stack = vm.stack[:len(vm.stack)-2*nelems]
+		err := vm.checkSize(mapVal)
+		if err != nil {
+			return 0, err
 		}
 		vm.pushStack(mapVal)
-	} else if inst.Name == "LIST_NEXT" {
-		listVal := vm.stack[len(vm.stack)-1].(*data.TorinoList)
+	case compiler.GET_ITER:
+		nvars := int(code.Code[pc+1])
+		iterVal, err := getIterator(vm.popStack(), nvars)
+		if err != nil {
+			return 0, err
+		}
+		vm.pushStack(iterVal)
+	case compiler.UNPACK_SEQUENCE:
+		n := int(code.Code[pc+1])
+		listVal, ok := vm.popStack().(*data.TorinoList)
+		if !ok || len(listVal.Values) != n {
+			return 0, errs.NewRuntimeError(errs.CODE_VALUE, fmt.Sprintf("expected a list of %d values to unpack", n))
+		}
 
-		if len(listVal.Values) > 0 {
-			vm.pushStack(listVal.Values[len(listVal.Values)-1])
-			listVal.Values = listVal.Values[:len(listVal.Values)-1]
-			return 1, nil
+		// Push in reverse so that the first value ends up on top of the stack.
+		for i := n - 1; i >= 0; i-- {
+			vm.pushStack(listVal.Values[i])
+		}
+	case compiler.FOR_ITER:
+		// Only GET_ITER pushes iterators, but a decoded module may not have been
+		// compiled from source.
+		iterVal, ok := vm.stack[len(vm.stack)-1].(*data.TorinoIterator)
+		if !ok {
+			return 0, errs.NewRuntimeError(errs.CODE_TYPE, "FOR_ITER requires an iterator")
+		}
+
+		val, ok := iterVal.Next()
+		if ok {
+			vm.pushStack(val)
+			return op.Width(), nil
 		} else {
-			return int(inst.Args[0].(*data.TorinoInt).Value), nil
+			return int(int32(code.Code[pc+1])), nil
 		}
-	} else if inst.Name == "POP_STACK" {
+	case compiler.POP_STACK:
 		vm.popStack()
-	} else if inst.Name == "RETURN_VALUE" {
+	case compiler.DUP_TOP_TWO:
+		n := len(vm.stack)
+		vm.pushStack(vm.stack[n-2])
+		vm.pushStack(vm.stack[n-1])
+	case compiler.ROT_TWO:
+		n := len(vm.stack)
+		vm.stack[n-2], vm.stack[n-1] = vm.stack[n-1], vm.stack[n-2]
+	case compiler.RETURN_VALUE:
 		return 0, nil
-	} else if inst.Name == "REL_JUMP_IF_FALSE" {
-		cond := vm.popStack().(*data.TorinoBool)
+	case compiler.REL_JUMP_IF_FALSE:
+		cond, ok := vm.popStack().(*data.TorinoBool)
+		if !ok {
+			return 0, errs.NewRuntimeError(errs.CODE_TYPE, "condition must be a boolean")
+		}
+
 		if !cond.Value {
-			return int(inst.Args[0].(*data.TorinoInt).Value), nil
+			return int(int32(code.Code[pc+1])), nil
 		} else {
-			return 1, nil
+			return op.Width(), nil
 		}
-	} else if inst.Name == "REL_JUMP" {
-		return int(inst.Args[0].(*data.TorinoInt).Value), nil
-	} else {
-		return 0, errors.New(fmt.Sprintf("unknown instruction %s", inst.Name))
+	case compiler.REL_JUMP_IF_FALSE_OR_POP:
+		// Used for `and`: jump and keep the top of the stack if it is false,
+		// otherwise pop it and continue.
+		cond, ok := vm.stack[len(vm.stack)-1].(*data.TorinoBool)
+		if !ok {
+			return 0, errs.NewRuntimeError(errs.CODE_TYPE, "and takes boolean operands")
+		}
+
+		if !cond.Value {
+			return int(int32(code.Code[pc+1])), nil
+		} else {
+			vm.popStack()
+			return op.Width(), nil
+		}
+	case compiler.REL_JUMP_IF_TRUE_OR_POP:
+		// Used for `or`: jump and keep the top of the stack if it is true,
+		// otherwise pop it and continue.
+		cond, ok := vm.stack[len(vm.stack)-1].(*data.TorinoBool)
+		if !ok {
+			return 0, errs.NewRuntimeError(errs.CODE_TYPE, "or takes boolean operands")
+		}
+
+		if cond.Value {
+			return int(int32(code.Code[pc+1])), nil
+		} else {
+			vm.popStack()
+			return op.Width(), nil
+		}
+	case compiler.REL_JUMP:
+		return int(int32(code.Code[pc+1])), nil
+	default:
+		return 0, errs.NewRuntimeError(errs.CODE_RUNTIME, fmt.Sprintf("unknown instruction %s", op))
+	}
+
+	return op.Width(), nil
+}
+
+// Call a function value with the given arguments, and return its result once it
+// has finished. This is for calls made by builtins; calls made by Torino code to
+// user-defined functions only push a new frame. `callSite` is the location of the
+// call, for tracebacks.
+func (vm *VirtualMachine) callFunction(
+	f data.TorinoValue, args []data.TorinoValue, callSite *lexer.Location) (data.TorinoValue, error) {
+	switch v := f.(type) {
+	case *data.TorinoBuiltin:
+		return v.F(args...)
+	case *vmBuiltin:
+		return v.f(vm, callSite, args...)
+	case *compiler.TorinoClosure:
+		for _, arg := range args {
+			vm.pushStack(arg)
+		}
+
+		err := vm.pushFrame(v, len(args), callSite)
+		if err != nil {
+			vm.stack = vm.stack[:len(vm.stack)-len(args)]
+			return nil, err
+		}
+		return vm.run()
+	default:
+		return nil, errs.NewRuntimeError(errs.CODE_TYPE, "cannot apply non-function")
+	}
+}
+
+// Push a frame for a call to a closure whose `nargs` arguments are on top of the
+// stack.
+func (vm *VirtualMachine) pushFrame(
+	closure *compiler.TorinoClosure, nargs int, callSite *lexer.Location) error {
+	f := closure.Function
+	if nargs != len(f.Params) {
+		return errs.NewRuntimeError(errs.CODE_ARGUMENTS, "wrong number of arguments to user-defined function")
+	}
+
+	// Only the frames of functions count towards the limit, so that a function may be
+	// called as deeply from Go as from a program.
+	if len(vm.frames)-vm.programs >= vm.recursionLimit {
+		return errs.NewRuntimeError(errs.CODE_RECURSION, "maximum recursion depth exceeded")
 	}
 
-	return 1, nil
+	// The function sees only its own locals, the variables it captured, and the
+	// globals, not the caller's locals.
+	base := len(vm.stack) - nargs
+	for i := nargs; i < len(f.Body.LocalNames); i++ {
+		vm.pushStack(nil)
+	}
+	vm.frames = append(vm.frames, &callFrame{f.Name, f.Body, 0, base, closure.Upvalues, callSite})
+	return nil
 }
 
-func (vm *VirtualMachine) pushStack(vals ...data.TorinoValue) {
-	vm.stack = append(vm.stack, vals...)
+func (vm *VirtualMachine) pushStack(val data.TorinoValue) {
+	vm.stack = append(vm.stack, val)
 }
 
 func (vm *VirtualMachine) popStack() data.TorinoValue {
@@ -282,14 +792,38 @@ func (vm *VirtualMachine) popStack() data.TorinoValue {
 	return ret
 }
 
-func (vm *VirtualMachine) popTwoInts() (*data.TorinoInt, *data.TorinoInt, bool) {
-	left, ok1 := vm.popStack().(*data.TorinoInt)
-	right, ok2 := vm.popStack().(*data.TorinoInt)
-	return left, right, ok1 && ok2
+// Return the iterator that a for loop with `nvars` loop variables uses to iterate
+// over `val`. With two variables, each element is a pair of an index and an element,
+// or of a key and a value for maps.
+func getIterator(val data.TorinoValue, nvars int) (*data.TorinoIterator, error) {
+	if mapVal, ok := val.(*data.TorinoMap); ok && nvars == 2 {
+		return mapVal.Items(), nil
+	}
+
+	iterable, ok := val.(data.Iterable)
+	if !ok {
+		return nil, errs.NewRuntimeError(errs.CODE_TYPE, fmt.Sprintf("%s is not iterable", val.TypeName()))
+	}
+
+	if nvars == 2 {
+		return data.Enumerate(iterable.Iter()), nil
+	} else {
+		return iterable.Iter(), nil
+	}
+}
+
+// Pop n function arguments off the stack, in the order that they were pushed.
+func (vm *VirtualMachine) popArgs(n int) []data.TorinoValue {
+	args := make([]data.TorinoValue, n)
+	copy(args, vm.stack[len(vm.stack)-n:])
+	vm.stack = vm.stack[:len(vm.stack)-n]
+	return args
 }
 
-func (vm *VirtualMachine) popTwoBools() (*data.TorinoBool, *data.TorinoBool, bool) {
-	left, ok1 := vm.popStack().(*data.TorinoBool)
-	right, ok2 := vm.popStack().(*data.TorinoBool)
-	return left, right, ok1 && ok2
+// Pop the left and right operands of a binary operator, which are pushed in
+// reverse order.
+func (vm *VirtualMachine) popTwo() (data.TorinoValue, data.TorinoValue) {
+	left := vm.popStack()
+	right := vm.popStack()
+	return left, right
 }